@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 
 	"sourcegraph.com/sourcegraph/makex"
 )
@@ -13,6 +15,8 @@ import (
 var expand = flag.Bool("x", true, "expand globs in makefile prereqs")
 var cwd = flag.String("C", "", "change to this directory before doing anything")
 var file = flag.String("f", "Makefile", "path to Makefile")
+var touch = flag.Bool("t", false, "touch targets (mark them up to date) instead of running their recipes")
+var question = flag.Bool("q", false, "question mode: run nothing, and exit with status 0 if the targets are up to date, 1 if not, or 2 on error")
 
 func main() {
 	flag.Usage = func() {
@@ -39,19 +43,26 @@ The options are:
 
 	data, err := ioutil.ReadFile(*file)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	if *cwd != "" {
 		err := os.Chdir(*cwd)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	}
 
-	mf, err := makex.Parse(data)
+	var mf *makex.Makefile
+	if *question {
+		// Don't remake included makefiles, because that would run
+		// recipes.
+		mf, err = conf.ParseFile(*file, data)
+	} else {
+		mf, err = conf.ParseAndRemake(*file, data)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	goals := flag.Args()
@@ -65,28 +76,82 @@ The options are:
 	if *expand {
 		mf, err = conf.Expand(mf)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	}
 
 	mk := conf.NewMaker(mf, goals...)
 
-	targetSets, err := mk.TargetSetsNeedingBuild()
+	if *question {
+		upToDate, err := mk.UpToDate()
+		if err != nil {
+			fatal(err)
+		}
+		if !upToDate {
+			os.Exit(1)
+		}
+		return
+	}
+
+	staleSets, err := mk.StaleTargetSets()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	if len(targetSets) == 0 {
+	if len(staleSets) == 0 {
 		fmt.Println("Nothing to do.")
 	}
 
 	if conf.DryRun {
-		mk.DryRun(os.Stdout)
+		if err := mk.DryRun(os.Stdout); err != nil {
+			fatal(err)
+		}
+		if *touch {
+			return
+		}
+		// Print the recipes that would be run (and run those
+		// beginning with "+").
+		fmt.Println()
+	} else if conf.Explain {
+		for _, staleSet := range staleSets {
+			for _, stale := range staleSet {
+				log.Printf("makex: remaking target %q: %s", stale.Target, stale.Reason)
+			}
+		}
+	}
+
+	if *touch {
+		if err := mk.Touch(); err != nil {
+			fatal(err)
+		}
 		return
 	}
 
-	err = mk.Run()
+	if conf.KeepGoing {
+		skipped := make(chan makex.Rule)
+		mk.Skipped = skipped
+		go func() {
+			for rule := range skipped {
+				log.Printf("makex: target %q not remade because of errors", rule.Target())
+			}
+		}()
+	}
+
+	// Stop building (and kill running recipes) on interrupt.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = mk.RunContext(ctx)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+}
+
+// fatal prints err and exits with status 1 (or 2 in question mode, where
+// status 1 means that the targets are not up to date).
+func fatal(err error) {
+	log.Print(err)
+	if *question {
+		os.Exit(2)
 	}
+	os.Exit(1)
 }
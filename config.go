@@ -2,8 +2,10 @@ package makex
 
 import (
 	"flag"
+	"io/ioutil"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"sourcegraph.com/sourcegraph/rwvfs"
@@ -14,6 +16,55 @@ type Config struct {
 	ParallelJobs int
 	Verbose      bool
 	DryRun       bool
+
+	// KeepGoing is whether to continue building targets after a target
+	// fails to build. Only the targets that depend on a failed target are
+	// skipped.
+	KeepGoing bool
+
+	// AlwaysMake is whether to treat all targets as stale.
+	AlwaysMake bool
+
+	// AssumeOld holds files that are never rebuilt (even if they are older
+	// than their prereqs) and that never cause the targets that depend on
+	// them to be rebuilt.
+	AssumeOld []string
+
+	// AssumeNew holds files that are treated as though they were just
+	// modified, so that the targets that depend on them are rebuilt.
+	AssumeNew []string
+
+	// StateFile, if set, is the path (in FS) of a state file in which
+	// hashes of each target's prereqs and recipes are recorded when it is
+	// built. Targets are then only rebuilt if the contents of their
+	// prereqs or their (expanded) recipes have changed, regardless of
+	// mtimes.
+	StateFile string
+
+	// Explain is whether to print the reason why each target is rebuilt
+	// (by DryRun, and by the makex command before building).
+	Explain bool
+
+	// Staleness, if non-nil, decides whether targets are stale and need
+	// to be built. If nil, ModTimeChecker is used (or, if StateFile is
+	// set, a checker that compares content hashes).
+	Staleness StalenessChecker
+
+	// Shell is the program and arguments used to run recipes (the recipe is
+	// appended as the last argument), such as []string{"bash", "-euo",
+	// "pipefail", "-c"}. If empty, "sh -c" is used. The SHELL and
+	// .SHELLFLAGS variables in a Makefile take precedence over Shell.
+	Shell []string
+
+	// Executor, if non-nil, runs the commands in recipes. If nil,
+	// ShellExecutor is used.
+	Executor Executor
+
+	// Funcs are custom functions, implemented in Go, that may be called
+	// from Makefiles in the same way as built-in functions (e.g.,
+	// "$(name arg1,arg2)" or "$(call name,arg1,arg2)"). Built-in functions
+	// take precedence over Funcs of the same name.
+	Funcs map[string]Func
 }
 
 var Default = Config{
@@ -41,6 +92,110 @@ func (c *Config) pathExists(path string) (bool, error) {
 	return true, nil
 }
 
+func (c *Config) readFile(path string) ([]byte, error) {
+	f, err := c.fs().Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// touch updates the mtime of the file at path, creating it if it doesn't
+// exist. If the FileSystem is the OS's (because FS is nil), the mtime is set
+// with os.Chtimes. Otherwise, if the FileSystem can't set mtimes directly (by
+// implementing Chtimes), the file is rewritten with its current contents as a
+// last resort.
+func (c *Config) touch(path string) error {
+	fs := c.fs()
+	exists, err := c.pathExists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		now := time.Now()
+		if c.FS == nil {
+			// c.fs() is the current directory.
+			return os.Chtimes(path, now, now)
+		}
+		chfs, ok := fs.(chtimesFileSystem)
+		if w, isWrapped := fs.(walkableRWVFS); isWrapped && !ok {
+			chfs, ok = w.FileSystem.(chtimesFileSystem)
+		}
+		if ok {
+			return chfs.Chtimes(path, now, now)
+		}
+	}
+
+	var data []byte
+	if exists {
+		data, err = c.readFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	return c.createFile(path, data)
+}
+
+// A chtimesFileSystem is a FileSystem that can set the access and
+// modification times of files (as os.Chtimes does).
+type chtimesFileSystem interface {
+	Chtimes(path string, atime, mtime time.Time) error
+}
+
+// createFile creates (or truncates) the file at path and writes data to it.
+func (c *Config) createFile(path string, data []byte) error {
+	f, err := c.fs().Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replaceFile writes data to the file at path. If the FileSystem can rename
+// files (as the OS's can, when FS is nil), data is written to a temporary
+// file that is then renamed to path, so that path is never left partially
+// written. Otherwise, path is written in place.
+func (c *Config) replaceFile(path string, data []byte) error {
+	fs := c.fs()
+	var rename func(oldpath, newpath string) error
+	if c.FS == nil {
+		// c.fs() is the current directory.
+		rename = os.Rename
+	} else {
+		rfs, ok := fs.(renameFileSystem)
+		if w, isWrapped := fs.(walkableRWVFS); isWrapped && !ok {
+			rfs, ok = w.FileSystem.(renameFileSystem)
+		}
+		if ok {
+			rename = rfs.Rename
+		}
+	}
+	if rename == nil {
+		return c.createFile(path, data)
+	}
+
+	tmp := path + ".tmp"
+	if err := c.createFile(tmp, data); err != nil {
+		return err
+	}
+	if err := rename(tmp, path); err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// A renameFileSystem is a FileSystem that can rename files (as os.Rename
+// does).
+type renameFileSystem interface {
+	Rename(oldpath, newpath string) error
+}
+
 func (c *Config) modTime(path string) (time.Time, error) {
 	s, err := c.fs().Stat(path)
 	if err != nil {
@@ -58,4 +213,21 @@ func Flags(fs *flag.FlagSet, conf *Config, prefix string) {
 	fs.BoolVar(&conf.DryRun, prefix+"n", false, "dry run (don't actually run any commands)")
 	fs.IntVar(&conf.ParallelJobs, prefix+"j", runtime.GOMAXPROCS(0), "number of jobs to run in parallel")
 	fs.BoolVar(&conf.Verbose, prefix+"v", false, "verbose")
+	fs.BoolVar(&conf.KeepGoing, prefix+"k", false, "keep going (build targets that don't depend on failed targets)")
+	fs.BoolVar(&conf.AlwaysMake, prefix+"B", false, "always make (treat all targets as stale)")
+	fs.Var((*stringsFlag)(&conf.AssumeOld), prefix+"o", "assume this file is old (never rebuild it, or rebuild targets because of it); may be repeated")
+	fs.Var((*stringsFlag)(&conf.AssumeNew), prefix+"W", "assume this file is new (rebuild the targets that depend on it); may be repeated")
+	fs.BoolVar(&conf.Explain, prefix+"explain", false, "print the reason why each target is rebuilt")
+	fs.BoolVar(&conf.Explain, prefix+"d", false, "same as -explain")
+	fs.StringVar(&conf.StateFile, prefix+"state", "", "rebuild targets when the contents of their prereqs or their recipes change (instead of using mtimes), recording hashes in this file")
+}
+
+// stringsFlag is a flag.Value for a flag that may be specified multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
 }
@@ -0,0 +1,393 @@
+package makex
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A conditional is the state of an ifeq, ifneq, ifdef, or ifndef block being
+// parsed.
+type conditional struct {
+	// lineno and text are the line number and text of the directive that
+	// began the block.
+	lineno int
+	text   string
+
+	// active is whether the lines in the current branch are being parsed.
+	active bool
+
+	// taken is whether any branch (including the current branch) of the
+	// block has been taken. Once a branch has been taken, all subsequent
+	// "else" branches are skipped.
+	taken bool
+
+	// sawElse is whether a final "else" (with no condition) was seen.
+	sawElse bool
+}
+
+// skipping returns whether the current line is in a conditional branch that
+// is not being parsed.
+func (p *parser) skipping() bool {
+	for _, c := range p.conds {
+		if !c.active {
+			return true
+		}
+	}
+	return false
+}
+
+// parseConditional handles line if it is a conditional directive (ifeq,
+// ifneq, ifdef, ifndef, else, or endif), in which case ok is true.
+func (p *parser) parseConditional(line string) (ok bool, err error) {
+	keyword, args := splitDirective(line)
+	switch keyword {
+	case "ifeq", "ifneq", "ifdef", "ifndef":
+		c := &conditional{lineno: p.lineno, text: p.text}
+		if p.skipping() {
+			// Don't evaluate conditions inside skipped branches, and
+			// skip all of this block's branches.
+			c.taken = true
+		} else {
+			c.active, err = p.evalCondition(keyword, args)
+			if err != nil {
+				return true, err
+			}
+			c.taken = c.active
+		}
+		p.conds = append(p.conds, c)
+		return true, nil
+
+	case "else":
+		if len(p.conds) == 0 {
+			return true, p.errorf("else without if")
+		}
+		c := p.conds[len(p.conds)-1]
+		if c.sawElse {
+			return true, p.errorf("only one 'else' per conditional")
+		}
+		c.active = false
+		if args == "" {
+			c.sawElse = true
+			c.active = !c.taken
+			c.taken = true
+			return true, nil
+		}
+
+		// Handle "else ifeq ...", etc.
+		keyword, args = splitDirective(args)
+		switch keyword {
+		case "ifeq", "ifneq", "ifdef", "ifndef":
+		default:
+			return true, p.errorf("extraneous text after 'else' directive")
+		}
+		if c.taken {
+			// Also covers the case where the whole block is being
+			// skipped, since then c.taken was set when it began.
+			return true, nil
+		}
+		c.active, err = p.evalCondition(keyword, args)
+		if err != nil {
+			return true, err
+		}
+		c.taken = c.active
+		return true, nil
+
+	case "endif":
+		if len(p.conds) == 0 {
+			return true, p.errorf("extraneous 'endif'")
+		}
+		if args != "" {
+			return true, p.errorfAt(p.columnOf(args), "extraneous text after 'endif' directive")
+		}
+		p.conds = p.conds[:len(p.conds)-1]
+		return true, nil
+	}
+	return false, nil
+}
+
+// checkConditionalsClosed returns an error if there are more than depth
+// conditional blocks open, which means that a block begun in the current
+// makefile was not closed with "endif".
+func (p *parser) checkConditionalsClosed(depth int) error {
+	if len(p.conds) > depth {
+		c := p.conds[len(p.conds)-1]
+		return &ParseError{File: p.file, Line: c.lineno, Snippet: c.text, Err: errors.New("missing 'endif'")}
+	}
+	return nil
+}
+
+// evalCondition evaluates the condition of an ifeq, ifneq, ifdef, or ifndef
+// directive.
+func (p *parser) evalCondition(keyword, args string) (bool, error) {
+	x := p.expander()
+	switch keyword {
+	case "ifdef", "ifndef":
+		name, err := x.expand(args)
+		if err != nil {
+			return false, p.errorf("%s", err)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return false, p.errorfAt(p.columnOf(args), "invalid syntax in conditional")
+		}
+		v, _ := p.mf.Vars.lookup(name)
+		return (v.Value != "") == (keyword == "ifdef"), nil
+
+	default:
+		a, b, ok := splitConditionArgs(args)
+		if !ok {
+			return false, p.errorfAt(p.columnOf(args), "invalid syntax in conditional")
+		}
+		a, err := x.expand(a)
+		if err != nil {
+			return false, p.errorf("%s", err)
+		}
+		b, err = x.expand(b)
+		if err != nil {
+			return false, p.errorf("%s", err)
+		}
+		return (a == b) == (keyword == "ifeq"), nil
+	}
+}
+
+// splitDirective splits line into its first word (the directive keyword) and
+// the rest of the line, with surrounding whitespace removed.
+func splitDirective(line string) (keyword, args string) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexAny(line, " \t(\"'")
+	if i == -1 {
+		return line, ""
+	}
+	return line[:i], strings.TrimSpace(line[i:])
+}
+
+// splitConditionArgs splits the arguments of an ifeq or ifneq directive,
+// which are either of the form "(a,b)" or two quoted strings (such as "a"
+// 'b').
+func splitConditionArgs(args string) (a, b string, ok bool) {
+	if strings.HasPrefix(args, "(") {
+		end := closingParen(args, 0)
+		if end != len(args)-1 {
+			return "", "", false
+		}
+		comma := indexUnquoted(args[1:end], ',')
+		if comma == -1 {
+			return "", "", false
+		}
+		return strings.TrimSpace(args[1 : comma+1]), strings.TrimSpace(args[comma+2 : end]), true
+	}
+
+	var quoted []string
+	for len(args) > 0 && len(quoted) < 2 {
+		q := args[0]
+		if q != '"' && q != '\'' {
+			return "", "", false
+		}
+		end := strings.IndexByte(args[1:], q)
+		if end == -1 {
+			return "", "", false
+		}
+		quoted = append(quoted, args[1:end+1])
+		args = strings.TrimLeft(args[end+2:], " \t")
+	}
+	if len(quoted) != 2 || args != "" {
+		return "", "", false
+	}
+	return quoted[0], quoted[1], true
+}
+
+// An Include is a makefile included by an "include", "-include", or
+// "sinclude" directive.
+type Include struct {
+	// Path is the path of the included makefile in the FileSystem.
+	Path string
+
+	// Optional is whether the makefile was included with "-include" or
+	// "sinclude", which ignore makefiles that don't exist and can't be
+	// made.
+	Optional bool
+
+	// Missing is whether the makefile did not exist when it was read.
+	Missing bool
+
+	// Pos is the position of the directive that included the makefile.
+	Pos Pos
+}
+
+// parseInclude handles line if it is an include directive ("include",
+// "-include", or "sinclude"), in which case ok is true. The included
+// makefiles are read from the Config's FileSystem and parsed as though
+// their contents appeared in place of the directive.
+func (p *parser) parseInclude(line string) (ok bool, err error) {
+	keyword, args := splitDirective(line)
+	var optional bool
+	switch keyword {
+	case "include":
+	case "-include", "sinclude":
+		optional = true
+	default:
+		return false, nil
+	}
+	if strings.HasPrefix(args, ":") {
+		// A rule whose target is named "include", etc.
+		return false, nil
+	}
+
+	args, err = p.expander().expand(args)
+	if err != nil {
+		return true, p.errorf("%s", err)
+	}
+	paths, err := p.conf.globs(strings.Fields(args))
+	if err != nil {
+		return true, p.errorf("%s", err)
+	}
+
+	file, lineno, text := p.file, p.lineno, p.text
+	pos := p.pos()
+	for _, path := range paths {
+		for _, including := range p.including {
+			if including == path {
+				return true, p.errorf("recursive include of %q", path)
+			}
+		}
+
+		data, err := p.conf.readFile(path)
+		if os.IsNotExist(err) {
+			p.mf.Includes = append(p.mf.Includes, Include{Path: path, Optional: optional, Missing: true, Pos: pos})
+			continue
+		} else if err != nil {
+			return true, p.errorf("%s", err)
+		}
+		p.mf.Includes = append(p.mf.Includes, Include{Path: path, Optional: optional, Pos: pos})
+
+		p.including = append(p.including, path)
+		p.file = path
+		err = p.parse(data)
+		p.file, p.lineno, p.text = file, lineno, text
+		p.including = p.including[:len(p.including)-1]
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// checkIncludesExist returns a *ParseError (at the include directive) if a
+// makefile that was included with "include" (not "-include" or "sinclude")
+// does not exist and there is no rule to make it.
+func (p *parser) checkIncludesExist() error {
+	for _, inc := range p.mf.Includes {
+		if !inc.Missing || inc.Optional || p.mf.Rule(inc.Path) != nil {
+			continue
+		}
+		matched := false
+		for _, rule := range p.mf.PatternRules() {
+			if _, ok := rule.Match(inc.Path); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return &ParseError{
+				File: inc.Pos.File,
+				Line: inc.Pos.Line,
+				Err:  fmt.Errorf("included makefile %q not found and no rule to make it", inc.Path),
+			}
+		}
+	}
+	return nil
+}
+
+// remakableMakefiles returns the makefiles (of those given) that have rules
+// to remake them. Phony targets and makefiles whose rules are always run are
+// excluded, because they would always be remade.
+func (m *Maker) remakableMakefiles(makefiles []string) []string {
+	var remakable []string
+	seen := make(map[string]bool)
+	for _, mf := range makefiles {
+		if seen[mf] || isPhony(m, mf) {
+			continue
+		}
+		if rule := m.rule(mf); rule == nil || m.alwaysRun(rule) {
+			continue
+		}
+		seen[mf] = true
+		remakable = append(remakable, mf)
+	}
+	return remakable
+}
+
+// alwaysRun returns whether rule's recipes are run every time its target is
+// made, because it has a phony prereq or it is a double-colon rule with no
+// prereqs.
+func (m *Maker) alwaysRun(rule Rule) bool {
+	if rules, ok := rule.(doubleColonRules); ok {
+		for _, r := range rules {
+			if len(r.Prereqs()) == 0 {
+				return true
+			}
+		}
+	}
+	for _, p := range rule.Prereqs() {
+		if isPhony(m, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRemakeRestarts is the maximum number of times that ParseAndRemake will
+// re-parse a Makefile after remaking its included makefiles.
+const maxRemakeRestarts = 10
+
+// ParseAndRemake parses a Makefile and then, as GNU make does, tries to
+// remake each of the makefiles it included that has a rule. If any of them
+// were stale (or missing) and were remade, the Makefile is parsed again from
+// the start, so that it reads the new contents of the included makefiles.
+// The filename is used as in ParseFile.
+//
+// If AlwaysMake is set, the included makefiles are only forced to be remade
+// once; after that, they are remade only if they are stale. If DryRun is set,
+// the remake is only tried once (running just the "+" recipes), because the
+// included makefiles would otherwise stay stale; the Makefile is then parsed
+// again and returned.
+func (c *Config) ParseAndRemake(filename string, data []byte) (*Makefile, error) {
+	conf := *c
+	for restarts := 0; ; restarts++ {
+		mf, err := conf.ParseFile(filename, data)
+		if err != nil {
+			return nil, err
+		}
+
+		var goals []string
+		for _, inc := range mf.Includes {
+			goals = append(goals, inc.Path)
+		}
+		mk := conf.NewMaker(mf)
+		goals = mk.remakableMakefiles(goals)
+		if len(goals) == 0 {
+			return mf, nil
+		}
+
+		mk = conf.NewMaker(mf, goals...)
+		targetSets, err := mk.TargetSetsNeedingBuild()
+		if err != nil {
+			return nil, err
+		}
+		if len(targetSets) == 0 {
+			return mf, nil
+		}
+		if restarts == maxRemakeRestarts {
+			return nil, fmt.Errorf("included makefiles are still stale after being remade %d times", restarts)
+		}
+		if err := mk.Run(); err != nil {
+			return nil, err
+		}
+		if conf.DryRun {
+			return conf.ParseFile(filename, data)
+		}
+		conf.AlwaysMake = false
+	}
+}
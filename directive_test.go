@@ -0,0 +1,244 @@
+package makex
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestConfig_Parse_include(t *testing.T) {
+	tests := map[string]struct {
+		files        map[string]string
+		data         string
+		wantMakefile *Makefile
+		wantErr      error
+	}{
+		"include": {
+			files: map[string]string{"a.mk": "a = 1\nx: y"},
+			data: `
+include a.mk
+b = $(a)`,
+			wantMakefile: &Makefile{
+				Rules:    []Rule{&BasicRule{"x", []string{"y"}, nil}},
+				Vars:     Vars{"a": {Value: "1"}, "b": {Value: "$(a)"}},
+				Includes: []Include{{Path: "a.mk", Pos: Pos{"Makefile", 2}}},
+			},
+		},
+		"include multiple files": {
+			files: map[string]string{"a.mk": "a = 1", "dir/b.mk": "b = 2", "dir/c.mk": "c = 3"},
+			data: `
+dir = dir
+include a.mk $(dir)/*.mk`,
+			wantMakefile: &Makefile{
+				Vars: Vars{"a": {Value: "1"}, "b": {Value: "2"}, "c": {Value: "3"}, "dir": {Value: "dir"}},
+				Includes: []Include{
+					{Path: "a.mk", Pos: Pos{"Makefile", 3}},
+					{Path: "dir/b.mk", Pos: Pos{"Makefile", 3}},
+					{Path: "dir/c.mk", Pos: Pos{"Makefile", 3}},
+				},
+			},
+		},
+		"nested include": {
+			files: map[string]string{"a.mk": "include b.mk", "b.mk": "b = 2"},
+			data:  `include a.mk`,
+			wantMakefile: &Makefile{
+				Vars:     Vars{"b": {Value: "2"}},
+				Includes: []Include{{Path: "a.mk", Pos: Pos{"Makefile", 1}}, {Path: "b.mk", Pos: Pos{"a.mk", 1}}},
+			},
+		},
+		"optional include of missing file": {
+			data: `
+-include a.mk
+sinclude b.mk`,
+			wantMakefile: &Makefile{
+				Includes: []Include{
+					{Path: "a.mk", Optional: true, Missing: true, Pos: Pos{"Makefile", 2}},
+					{Path: "b.mk", Optional: true, Missing: true, Pos: Pos{"Makefile", 3}},
+				},
+			},
+		},
+		"include of missing file with rule": {
+			data: `
+include a.mk
+a.mk:
+	echo a = 1 > a.mk`,
+			wantMakefile: &Makefile{
+				Rules:    []Rule{&BasicRule{"a.mk", []string{}, []string{"echo a = 1 > a.mk"}}},
+				Includes: []Include{{Path: "a.mk", Missing: true, Pos: Pos{"Makefile", 2}}},
+			},
+		},
+		"include of missing file without rule": {
+			data:    "x:\ninclude a.mk",
+			wantErr: errors.New(`Makefile:2: included makefile "a.mk" not found and no rule to make it`),
+		},
+		"recursive include": {
+			files:   map[string]string{"a.mk": "include b.mk", "b.mk": "\ninclude a.mk"},
+			data:    `include a.mk`,
+			wantErr: errors.New(`b.mk:2: recursive include of "a.mk"`),
+		},
+		"unbalanced conditional in included file": {
+			files: map[string]string{"a.mk": "ifdef x"},
+			data: `
+ifndef y
+include a.mk
+endif
+endif`,
+			wantErr: errors.New(`a.mk:1: missing 'endif'`),
+		},
+		"rule named include": {
+			data:         `include: x`,
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"include", []string{"x"}, nil}}},
+		},
+	}
+	for label, test := range tests {
+		files := test.files
+		if files == nil {
+			files = map[string]string{}
+		}
+		conf := &Config{FS: NewFileSystem(rwvfs.Map(files))}
+		mf, err := conf.ParseFile("Makefile", []byte(test.data))
+		if fmt.Sprint(err) != fmt.Sprint(test.wantErr) {
+			if test.wantErr == nil {
+				t.Errorf("%s: Parse: error: %s", label, err)
+			} else {
+				t.Errorf("%s: Parse: error: got %q, want %q", label, err, test.wantErr)
+			}
+			continue
+		}
+		if mf != nil {
+			mf.pos = nil
+		}
+		if !reflect.DeepEqual(mf, test.wantMakefile) {
+			t.Errorf("%s: bad parsed Makefile\n=========== got Makefile\n%+v\n\n=========== want Makefile\n%+v", label, mf, test.wantMakefile)
+		}
+	}
+}
+
+func TestConfig_ParseAndRemake(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{FS: NewFileSystem(rwvfs.OS(tmpDir))}
+
+	dir := filepath.ToSlash(tmpDir)
+	mf, err := conf.ParseAndRemake("Makefile", []byte(`
+include a.mk
+-include b.mk
+a.mk:
+	echo 'a = 1' > `+dir+`/a.mk
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := mf.Vars["a"], (Var{Value: "1"}); got != want {
+		t.Errorf("got var a == %+v after remaking included makefile, want %+v", got, want)
+	}
+	wantIncludes := []Include{
+		{Path: "a.mk", Pos: Pos{"Makefile", 2}},
+		{Path: "b.mk", Optional: true, Missing: true, Pos: Pos{"Makefile", 3}},
+	}
+	if !reflect.DeepEqual(mf.Includes, wantIncludes) {
+		t.Errorf("got includes %+v, want %+v", mf.Includes, wantIncludes)
+	}
+}
+
+func TestConfig_ParseAndRemake_alwaysMake(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{FS: NewFileSystem(rwvfs.OS(tmpDir)), AlwaysMake: true}
+
+	dir := filepath.ToSlash(tmpDir)
+	mf, err := conf.ParseAndRemake("Makefile", []byte(`
+include a.mk
+a.mk:
+	echo x >> `+dir+`/count && echo 'a = 1' > `+dir+`/a.mk
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := mf.Vars["a"], (Var{Value: "1"}); got != want {
+		t.Errorf("got var a == %+v after remaking included makefile, want %+v", got, want)
+	}
+	if data, err := conf.readFile("count"); err != nil {
+		t.Fatal(err)
+	} else if got, want := string(data), "x\n"; got != want {
+		t.Errorf("got count %q, want the included makefile to be remade once", got)
+	}
+}
+
+func TestConfig_ParseAndRemake_dryRun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{FS: NewFileSystem(rwvfs.OS(tmpDir)), DryRun: true}
+
+	// Only the "+" recipe is run, so b.mk is remade but a.mk stays
+	// missing.
+	dir := filepath.ToSlash(tmpDir)
+	mf, err := conf.ParseAndRemake("Makefile", []byte(`
+-include a.mk b.mk
+a.mk:
+	echo 'a = 1' > `+dir+`/a.mk
+b.mk:
+	+echo 'b = 1' > `+dir+`/b.mk
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := mf.Vars["a"]; ok {
+		t.Error("got var a set, want a.mk to not be remade in dry-run mode")
+	}
+	if got, want := mf.Vars["b"], (Var{Value: "1"}); got != want {
+		t.Errorf("got var b == %+v after remaking included makefile, want %+v", got, want)
+	}
+}
+
+func TestConfig_ParseAndRemake_alwaysRun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{FS: NewFileSystem(rwvfs.OS(tmpDir))}
+
+	// Included makefiles whose rules are always run are not remade.
+	dir := filepath.ToSlash(tmpDir)
+	mf, err := conf.ParseAndRemake("Makefile", []byte(`
+-include a.mk b.mk
+a.mk::
+	echo 'a = 1' > `+dir+`/a.mk
+b.mk: force
+	echo 'b = 1' > `+dir+`/b.mk
+force:
+.PHONY: force
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		if v, ok := mf.Vars[name]; ok {
+			t.Errorf("got var %s == %+v, want the included makefile to not be remade", name, v)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package makex
+
+import "os/exec"
+
+// setProcessGroup does nothing on Windows, where process groups are not
+// supported.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd's process (but not the processes it started).
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
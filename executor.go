@@ -0,0 +1,80 @@
+package makex
+
+import (
+	"context"
+	"io"
+	"os/exec"
+)
+
+// An Executor runs the commands in rules' recipes. Set Config.Executor to use
+// a custom Executor (for example, to run commands in a container or on a
+// remote worker).
+type Executor interface {
+	// Execute runs cmd, which is a command from rule's recipes, and returns
+	// when it has finished. A non-nil error means that the command failed.
+	// If ctx is done before the command finishes, Execute should stop it
+	// and return ctx.Err().
+	//
+	// Execute may be called concurrently for different rules.
+	Execute(ctx context.Context, rule Rule, cmd *Command) error
+}
+
+// A Command is a command from a rule's recipes to be run by an Executor.
+type Command struct {
+	// Recipe is the recipe line (or, with .ONESHELL, all of the rule's
+	// recipe lines) to run, with variables expanded and its prefixes
+	// ("@", "-", and "+") removed.
+	Recipe string
+
+	// Shell is the program and arguments used to run Recipe, which is
+	// passed as the last argument (such as []string{"sh", "-c"}).
+	Shell []string
+
+	// Env is the environment to run the command in, as a list of
+	// "key=value" strings.
+	Env []string
+
+	// Dir is the directory to run the command in.
+	Dir string
+
+	// Stdout and Stderr receive the command's output.
+	Stdout, Stderr io.Writer
+}
+
+// ShellExecutor is the default Executor. It runs commands on the local
+// machine, with the shell in Command.Shell. If ctx is done, the command (and
+// any processes it started) is killed.
+type ShellExecutor struct{}
+
+// Execute implements Executor.
+func (ShellExecutor) Execute(ctx context.Context, rule Rule, cmd *Command) error {
+	// cmd.Shell may be shared with concurrent commands, so don't append
+	// to it.
+	args := append(append([]string(nil), cmd.Shell[1:]...), cmd.Recipe)
+	c := exec.Command(cmd.Shell[0], args...)
+	c.Env, c.Dir = cmd.Env, cmd.Dir
+	c.Stdout, c.Stderr = cmd.Stdout, cmd.Stderr
+	return runCommand(ctx, c)
+}
+
+// runCommand runs cmd, killing it (and any processes it started) if ctx is
+// done before it exits.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return ctx.Err()
+	}
+}
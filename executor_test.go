@@ -0,0 +1,137 @@
+package makex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// fakeExecutor is an Executor that records the commands it is given instead
+// of running them. Commands named in fail return an error.
+type fakeExecutor struct {
+	mu       sync.Mutex
+	commands []string
+	fail     map[string]bool
+}
+
+func (e *fakeExecutor) Execute(ctx context.Context, rule Rule, cmd *Command) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commands = append(e.commands, fmt.Sprintf("%s: %v %s", rule.Target(), cmd.Shell, cmd.Recipe))
+	fmt.Fprintln(cmd.Stdout, cmd.Recipe)
+	if e.fail[cmd.Recipe] {
+		return errors.New("fake failure")
+	}
+	return nil
+}
+
+func TestConfig_Executor(t *testing.T) {
+	mf, err := Parse([]byte(`
+x: y
+	echo $@
+	-oops
+y:
+	@echo $@
+	+echo always
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dryRun       bool
+		wantCommands []string
+		wantStdout   string
+	}{
+		{
+			wantCommands: []string{"y: [sh -c] echo y", "y: [sh -c] echo always", "x: [sh -c] echo x", "x: [sh -c] oops"},
+			wantStdout:   "echo y\necho always\necho x\noops\n",
+		},
+		{
+			dryRun:       true,
+			wantCommands: []string{"y: [sh -c] echo always"},
+			wantStdout:   "echo y\necho always\necho x\noops\n",
+		},
+	}
+	for _, test := range tests {
+		executor := &fakeExecutor{fail: map[string]bool{"oops": true}}
+		conf := &Config{
+			FS:       NewFileSystem(rwvfs.Map(map[string]string{})),
+			DryRun:   test.dryRun,
+			Executor: executor,
+		}
+		mk := conf.NewMaker(mf, "x")
+		var stdout bytes.Buffer
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{&stdout}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+		if err := mk.Run(); err != nil {
+			t.Errorf("DryRun=%v: %s", test.dryRun, err)
+			continue
+		}
+		if !reflect.DeepEqual(executor.commands, test.wantCommands) {
+			t.Errorf("DryRun=%v: got commands %q, want %q", test.dryRun, executor.commands, test.wantCommands)
+		}
+		if got := stdout.String(); got != test.wantStdout {
+			t.Errorf("DryRun=%v: got stdout %q, want %q", test.dryRun, got, test.wantStdout)
+		}
+	}
+}
+
+func TestConfig_Executor_failure(t *testing.T) {
+	mf, err := new(Config).ParseFile("Makefile", []byte("x:\n\tbad\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{
+		FS:       NewFileSystem(rwvfs.Map(map[string]string{})),
+		Executor: &fakeExecutor{fail: map[string]bool{"bad": true}},
+	}
+	mk := conf.NewMaker(mf, "x")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	err = mk.Run()
+	if got, want := fmt.Sprint(err), "Makefile:1: recipe for target 'x' failed: command failed: bad (fake failure)"; got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+}
+
+func TestShellExecutor_sharedShell(t *testing.T) {
+	// cmd.Shell may be shared by concurrent commands, so Execute must not
+	// append the recipe to it (which would overwrite its spare capacity).
+	shell := make([]string, 2, 3)
+	copy(shell, []string{"sh", "-c"})
+	var stdout bytes.Buffer
+	cmd := &Command{Recipe: "echo hi", Shell: shell, Stdout: &stdout, Stderr: ioutil.Discard}
+	if err := (ShellExecutor{}).Execute(context.Background(), &BasicRule{TargetFile: "x"}, cmd); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "hi\n" {
+		t.Errorf("got stdout %q, want %q", got, "hi\n")
+	}
+	if spare := shell[:3][2]; spare != "" {
+		t.Errorf("got %q written past the end of cmd.Shell, want it to be unmodified", spare)
+	}
+
+	// Maker.shell returns a copy of Config.Shell.
+	conf := &Config{Shell: shell}
+	mf := &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x"}}}
+	got, err := conf.NewMaker(mf, "x").shell(mf.Rules[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got[0] = "bash"
+	if shell[0] != "sh" {
+		t.Error("modifying the shell returned by Maker.shell modified Config.Shell")
+	}
+}
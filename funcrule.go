@@ -0,0 +1,59 @@
+package makex
+
+import (
+	"context"
+	"io"
+	"log"
+)
+
+// A FuncRule is a rule whose recipe is a Go function. The Maker calls its Run
+// method to make its targets instead of running its Recipes in a shell. As
+// with shell recipes, its output goes to the writers returned by
+// Maker.RuleOutput, it is reported on the Maker's Started, Ended, Succeeded,
+// and Failed channels, and if Run fails, its targets are removed (unless they
+// are .PRECIOUS). Run is not called if DryRun is set.
+type FuncRule interface {
+	Rule
+
+	// Run makes the rule's targets. It should return promptly (with
+	// ctx.Err()) if ctx is done.
+	Run(ctx context.Context, rc *RuleContext) error
+}
+
+// A RuleContext holds information about a FuncRule being run.
+type RuleContext struct {
+	// Target is the rule's (first) target, and Targets are all of its
+	// targets.
+	Target  string
+	Targets []string
+
+	// Prereqs are the rule's prereqs.
+	Prereqs []string
+
+	// Stdout and Stderr receive the rule's output, and Log logs messages
+	// about the rule.
+	Stdout, Stderr io.Writer
+	Log            *log.Logger
+
+	// FS is the Config's FileSystem.
+	FS FileSystem
+}
+
+// GoRule is a FuncRule that calls a Go function to make its target.
+type GoRule struct {
+	TargetFile  string
+	PrereqFiles []string
+	Func        func(ctx context.Context, rc *RuleContext) error
+}
+
+// Target implements Rule.
+func (r *GoRule) Target() string { return r.TargetFile }
+
+// Prereqs implements Rule.
+func (r *GoRule) Prereqs() []string { return r.PrereqFiles }
+
+// Recipes implements Rule. A GoRule has no shell recipes.
+func (r *GoRule) Recipes() []string { return nil }
+
+// Run implements FuncRule.
+func (r *GoRule) Run(ctx context.Context, rc *RuleContext) error { return r.Func(ctx, rc) }
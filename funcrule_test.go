@@ -0,0 +1,122 @@
+package makex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_Run_funcRule(t *testing.T) {
+	fs := NewFileSystem(rwvfs.Map(map[string]string{"in": "data"}))
+	var gotContext *RuleContext
+	mf := &Makefile{Rules: []Rule{
+		&GoRule{
+			TargetFile:  "out",
+			PrereqFiles: []string{"in"},
+			Func: func(ctx context.Context, rc *RuleContext) error {
+				gotContext = rc
+				data, err := (&Config{FS: rc.FS}).readFile(rc.Prereqs[0])
+				if err != nil {
+					return err
+				}
+				f, err := rc.FS.Create(rc.Target)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				fmt.Fprintln(rc.Stdout, "copying")
+				_, err = f.Write(data)
+				return err
+			},
+		},
+	}}
+
+	conf := &Config{FS: fs}
+	mk := conf.NewMaker(mf, "out")
+	var stdout bytes.Buffer
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{&stdout}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	started, succeeded := make(chan Rule, 1), make(chan Rule, 1)
+	mk.Started, mk.Succeeded = started, succeeded
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := conf.readFile("out"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "data" {
+		t.Errorf("got out contents %q, want %q", data, "data")
+	}
+	if got, want := stdout.String(), "copying\n"; got != want {
+		t.Errorf("got stdout %q, want %q", got, want)
+	}
+	if gotContext == nil || gotContext.Target != "out" || !reflect.DeepEqual(gotContext.Targets, []string{"out"}) {
+		t.Errorf("got RuleContext %+v, want target out", gotContext)
+	}
+	if r := <-started; r != mf.Rules[0] {
+		t.Errorf("got started rule %v, want the GoRule", r)
+	}
+	if r := <-succeeded; r != mf.Rules[0] {
+		t.Errorf("got succeeded rule %v, want the GoRule", r)
+	}
+
+	// The target is up to date now.
+	if upToDate, err := conf.NewMaker(mf, "out").UpToDate(); err != nil {
+		t.Fatal(err)
+	} else if !upToDate {
+		t.Error("got UpToDate false after Run, want true")
+	}
+}
+
+func TestMaker_Run_funcRuleFailed(t *testing.T) {
+	fs := NewFileSystem(rwvfs.Map(map[string]string{}))
+	mf := &Makefile{Rules: []Rule{
+		&GoRule{
+			TargetFile: "out",
+			Func: func(ctx context.Context, rc *RuleContext) error {
+				f, err := rc.FS.Create(rc.Target)
+				if err != nil {
+					return err
+				}
+				f.Close()
+				return errors.New("oops")
+			},
+		},
+	}}
+
+	conf := &Config{FS: fs}
+	mk := conf.NewMaker(mf, "out")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	failed := make(chan RuleBuildError, 1)
+	mk.Failed = failed
+	err := mk.Run()
+	if got, want := fmt.Sprint(err), "recipe function failed (oops)"; got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+	if e := <-failed; e.Rule != mf.Rules[0] {
+		t.Errorf("got failed rule %v, want the GoRule", e.Rule)
+	}
+	if isFile(fs, "out") {
+		t.Error("target out exists after failure; want it to be removed")
+	}
+
+	// Run is not called in dry-run mode.
+	conf.DryRun = true
+	if err := conf.NewMaker(mf, "out").Run(); err != nil {
+		t.Errorf("DryRun: %s", err)
+	}
+	if isFile(fs, "out") {
+		t.Error("DryRun: target out exists; want Run to not be called")
+	}
+}
@@ -0,0 +1,441 @@
+package makex
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A makeFunc is a built-in make function, such as $(subst ...).
+type makeFunc struct {
+	// minArgs and maxArgs are the minimum and maximum number of arguments.
+	// If a call has more than maxArgs comma-separated arguments, the extra
+	// commas are part of the last argument. If maxArgs is 0, there is no
+	// maximum.
+	minArgs, maxArgs int
+
+	// lazy is whether the function expands its own arguments. Otherwise,
+	// they are expanded before the function is called.
+	lazy bool
+
+	call func(x *expander, args []string) (string, error)
+}
+
+// builtinFuncs are the GNU make built-in functions that makex supports.
+var builtinFuncs map[string]makeFunc
+
+func init() {
+	builtinFuncs = map[string]makeFunc{
+		"subst":      {3, 3, false, funcSubst},
+		"patsubst":   {3, 3, false, funcPatsubst},
+		"strip":      {1, 1, false, funcStrip},
+		"findstring": {2, 2, false, funcFindstring},
+		"filter":     {2, 2, false, funcFilter},
+		"filter-out": {2, 2, false, funcFilterOut},
+		"sort":       {1, 1, false, funcSort},
+		"word":       {2, 2, false, funcWord},
+		"words":      {1, 1, false, funcWords},
+		"firstword":  {1, 1, false, funcFirstword},
+		"lastword":   {1, 1, false, funcLastword},
+		"dir":        {1, 1, false, funcDir},
+		"notdir":     {1, 1, false, funcNotdir},
+		"suffix":     {1, 1, false, funcSuffix},
+		"basename":   {1, 1, false, funcBasename},
+		"addsuffix":  {2, 2, false, funcAddsuffix},
+		"addprefix":  {2, 2, false, funcAddprefix},
+		"wildcard":   {1, 1, false, funcWildcard},
+		"foreach":    {3, 3, true, funcForeach},
+		"if":         {2, 3, true, funcIf},
+		"call":       {1, 0, false, funcCall},
+		"shell":      {1, 1, false, funcShell},
+		"error":      {1, 1, false, funcError},
+	}
+}
+
+// splitFuncCall splits the text inside a variable reference into a function
+// name and its (unexpanded) arguments text, if the reference is a function
+// call. Otherwise ok is false.
+func splitFuncCall(ref string) (name, args string, ok bool) {
+	i := strings.IndexAny(ref, " \t")
+	if i == -1 {
+		return "", "", false
+	}
+	return ref[:i], strings.TrimLeft(ref[i+1:], " \t"), true
+}
+
+// callFunc calls the function fn (named name) with the unexpanded arguments
+// text args.
+func (x *expander) callFunc(name string, fn makeFunc, args string) (string, error) {
+	argv := splitArgs(args, fn.maxArgs)
+	if len(argv) < fn.minArgs {
+		return "", fmt.Errorf("insufficient number of arguments (%d) to function %q", len(argv), name)
+	}
+	if !fn.lazy {
+		for i, arg := range argv {
+			var err error
+			argv[i], err = x.expand(arg)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return fn.call(x, argv)
+}
+
+// splitArgs splits s at the commas that are not inside parentheses or braces,
+// into at most n parts (or any number of parts, if n is 0).
+func splitArgs(s string, n int) []string {
+	var args []string
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case ',':
+			if depth == 0 && (n == 0 || len(args) < n-1) {
+				args = append(args, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(args, s[start:])
+}
+
+// matchPattern reports whether word matches pattern, in which the first "%"
+// matches any substring (the stem). If pattern has no "%", it must equal
+// word.
+func matchPattern(pattern, word string) (stem string, ok bool) {
+	i := strings.Index(pattern, "%")
+	if i == -1 {
+		return "", pattern == word
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(word) < len(prefix)+len(suffix) || !strings.HasPrefix(word, prefix) || !strings.HasSuffix(word, suffix) {
+		return "", false
+	}
+	return word[len(prefix) : len(word)-len(suffix)], true
+}
+
+// patsubst replaces the words of text that match pattern with replacement,
+// in which "%" stands for the stem.
+func patsubst(pattern, replacement, text string) string {
+	pattern = strings.TrimSpace(pattern)
+	replacement = strings.TrimSpace(replacement)
+	words := strings.Fields(text)
+	for i, word := range words {
+		stem, ok := matchPattern(pattern, word)
+		if !ok {
+			continue
+		}
+		if strings.Contains(pattern, "%") {
+			words[i] = strings.Replace(replacement, "%", stem, 1)
+		} else {
+			words[i] = replacement
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// mapWords applies f to each whitespace-separated word of text.
+func mapWords(text string, f func(word string) string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = f(word)
+	}
+	return strings.Join(words, " ")
+}
+
+func funcSubst(x *expander, args []string) (string, error) {
+	return strings.Replace(args[2], args[0], args[1], -1), nil
+}
+
+func funcPatsubst(x *expander, args []string) (string, error) {
+	return patsubst(args[0], args[1], args[2]), nil
+}
+
+func funcStrip(x *expander, args []string) (string, error) {
+	return strings.Join(strings.Fields(args[0]), " "), nil
+}
+
+func funcFindstring(x *expander, args []string) (string, error) {
+	if strings.Contains(args[1], args[0]) {
+		return args[0], nil
+	}
+	return "", nil
+}
+
+func funcFilter(x *expander, args []string) (string, error) {
+	return filterWords(args[0], args[1], true), nil
+}
+
+func funcFilterOut(x *expander, args []string) (string, error) {
+	return filterWords(args[0], args[1], false), nil
+}
+
+// filterWords returns the words of text that match (if keep is true) or
+// don't match (if keep is false) any of the words of patterns.
+func filterWords(patterns, text string, keep bool) string {
+	var words []string
+	for _, word := range strings.Fields(text) {
+		matched := false
+		for _, pattern := range strings.Fields(patterns) {
+			if _, ok := matchPattern(pattern, word); ok {
+				matched = true
+				break
+			}
+		}
+		if matched == keep {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func funcSort(x *expander, args []string) (string, error) {
+	return strings.Join(uniqAndSort(strings.Fields(args[0])), " "), nil
+}
+
+func funcWord(x *expander, args []string) (string, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(args[0]))
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("first argument to function \"word\" must be greater than 0: %q", args[0])
+	}
+	words := strings.Fields(args[1])
+	if n > len(words) {
+		return "", nil
+	}
+	return words[n-1], nil
+}
+
+func funcWords(x *expander, args []string) (string, error) {
+	return strconv.Itoa(len(strings.Fields(args[0]))), nil
+}
+
+func funcFirstword(x *expander, args []string) (string, error) {
+	words := strings.Fields(args[0])
+	if len(words) == 0 {
+		return "", nil
+	}
+	return words[0], nil
+}
+
+func funcLastword(x *expander, args []string) (string, error) {
+	words := strings.Fields(args[0])
+	if len(words) == 0 {
+		return "", nil
+	}
+	return words[len(words)-1], nil
+}
+
+func funcDir(x *expander, args []string) (string, error) {
+	return mapWords(args[0], func(word string) string {
+		i := strings.LastIndex(word, "/")
+		if i == -1 {
+			return "./"
+		}
+		return word[:i+1]
+	}), nil
+}
+
+func funcNotdir(x *expander, args []string) (string, error) {
+	return mapWords(args[0], func(word string) string {
+		return word[strings.LastIndex(word, "/")+1:]
+	}), nil
+}
+
+func funcSuffix(x *expander, args []string) (string, error) {
+	var suffixes []string
+	for _, word := range strings.Fields(args[0]) {
+		if ext := path.Ext(word); ext != "" {
+			suffixes = append(suffixes, ext)
+		}
+	}
+	return strings.Join(suffixes, " "), nil
+}
+
+func funcBasename(x *expander, args []string) (string, error) {
+	return mapWords(args[0], func(word string) string {
+		return strings.TrimSuffix(word, path.Ext(word))
+	}), nil
+}
+
+func funcAddsuffix(x *expander, args []string) (string, error) {
+	return mapWords(args[1], func(word string) string { return word + args[0] }), nil
+}
+
+func funcAddprefix(x *expander, args []string) (string, error) {
+	return mapWords(args[1], func(word string) string { return args[0] + word }), nil
+}
+
+// funcWildcard returns the files in the Config's FileSystem that match the
+// glob patterns. Patterns without glob characters match only files that
+// exist.
+func funcWildcard(x *expander, args []string) (string, error) {
+	c := x.conf
+	if c == nil {
+		c = &Config{}
+	}
+	var files []string
+	for _, pattern := range strings.Fields(args[0]) {
+		if !strings.ContainsAny(pattern, "*?[]") {
+			exists, err := c.pathExists(pattern)
+			if err != nil {
+				return "", err
+			}
+			if exists {
+				files = append(files, pattern)
+			}
+			continue
+		}
+		matches, err := c.glob(pattern)
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return strings.Join(files, " "), nil
+}
+
+func funcForeach(x *expander, args []string) (string, error) {
+	name, err := x.expand(args[0])
+	if err != nil {
+		return "", err
+	}
+	list, err := x.expand(args[1])
+	if err != nil {
+		return "", err
+	}
+
+	var results []string
+	for _, word := range strings.Fields(list) {
+		x2 := x.withLocals(Vars{strings.TrimSpace(name): {Value: word, Simple: true}})
+		result, err := x2.expand(args[2])
+		if err != nil {
+			return "", err
+		}
+		results = append(results, result)
+	}
+	return strings.Join(results, " "), nil
+}
+
+func funcIf(x *expander, args []string) (string, error) {
+	cond, err := x.expand(args[0])
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(cond) != "" {
+		return x.expand(args[1])
+	}
+	if len(args) == 3 {
+		return x.expand(args[2])
+	}
+	return "", nil
+}
+
+// funcCall expands the variable named by the first argument, with $(0) set
+// to the variable's name and $(1), $(2), etc., set to the remaining
+// arguments.
+func funcCall(x *expander, args []string) (string, error) {
+	name := strings.TrimSpace(args[0])
+	if fn, ok := x.lookupFunc(name); ok {
+		return x.callFunc(name, fn, strings.Join(args[1:], ","))
+	}
+
+	if x.callDepth == maxCallDepth {
+		return "", fmt.Errorf("function %q called recursively more than %d times", name, maxCallDepth)
+	}
+	params := Vars{"0": {Value: name, Simple: true}}
+	for i, arg := range args[1:] {
+		params[strconv.Itoa(i+1)] = Var{Value: arg, Simple: true}
+	}
+	x2 := x.withLocals(params)
+	x2.callDepth++
+	// Variables may call themselves recursively using "call".
+	x2.active = nil
+	return x2.ref(name, "")
+}
+
+// maxCallDepth is the maximum depth of nested "call" function calls.
+const maxCallDepth = 1000
+
+func funcShell(x *expander, args []string) (string, error) {
+	return shellOutput(args[0])
+}
+
+func funcError(x *expander, args []string) (string, error) {
+	return "", fmt.Errorf("%s", args[0])
+}
+
+// substitutionRef expands a substitution reference of the form $(var:a=b),
+// which replaces the suffix a with b in each word of var's value (or, if a
+// contains "%", is equivalent to $(patsubst a,b,$(var))).
+func (x *expander) substitutionRef(name, from, to string) (string, error) {
+	val, err := x.ref(name, "")
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(from, "%") {
+		from, to = "%"+from, "%"+to
+	}
+	return patsubst(from, to, val), nil
+}
+
+// splitSubstitutionRef splits the text inside a variable reference of the
+// form $(var:a=b) into its parts. If ref is not a substitution reference, ok
+// is false.
+func splitSubstitutionRef(ref string) (name, from, to string, ok bool) {
+	colon := indexUnquoted(ref, ':')
+	if colon == -1 {
+		return "", "", "", false
+	}
+	eq := strings.IndexByte(ref[colon:], '=')
+	if eq == -1 {
+		return "", "", "", false
+	}
+	return ref[:colon], ref[colon+1 : colon+eq], ref[colon+eq+1:], true
+}
+
+// A Func is a custom make function registered in Config.Funcs. It is called
+// with its arguments (split at commas and expanded) and returns the text that
+// the function call expands to.
+type Func func(args []string) (string, error)
+
+// lookupFunc returns the function with the given name, which is either a
+// built-in function or a function registered in the Config's Funcs.
+func (x *expander) lookupFunc(name string) (makeFunc, bool) {
+	if fn, ok := builtinFuncs[name]; ok {
+		return fn, true
+	}
+	if x.conf != nil {
+		if fn, ok := x.conf.Funcs[name]; ok {
+			return makeFunc{call: func(x *expander, args []string) (string, error) {
+				val, err := fn(args)
+				if err != nil {
+					return "", fmt.Errorf("function %q: %s", name, err)
+				}
+				return val, nil
+			}}, true
+		}
+	}
+	return makeFunc{}, false
+}
+
+// withLocals returns a copy of x that expands references to the variables in
+// locals (which take precedence over all other variables).
+func (x *expander) withLocals(locals Vars) *expander {
+	x2 := *x
+	x2.locals = make(Vars, len(x.locals)+len(locals))
+	for name, v := range x.locals {
+		x2.locals[name] = v
+	}
+	for name, v := range locals {
+		x2.locals[name] = v
+	}
+	return &x2
+}
@@ -0,0 +1,144 @@
+package makex
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestExpander_funcs(t *testing.T) {
+	conf := &Config{FS: NewFileSystem(rwvfs.Map(map[string]string{
+		"a.go": "", "b.go": "", "c.txt": "", "dir/d.go": "",
+	}))}
+	vars := Vars{
+		"srcs":    {Value: "a.c b.c", Simple: true},
+		"reverse": {Value: "$(if $(1),$(call reverse,$(wordlist2)) $(firstword $(1)))"},
+		"pair":    {Value: "$(1)-$(2)"},
+	}
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`$(subst ee,EE,feet on the street)`, "fEEt on the strEEt"},
+		{`$(subst a,b,x,a)`, "x,b"},
+		{`$(patsubst %.c,%.o,x.c.c bar.c baz)`, "x.c.o bar.o baz"},
+		{`$(patsubst bar.c,y,x.c bar.c)`, "x.c y"},
+		{`$(srcs:.c=.o)`, "a.o b.o"},
+		{`$(srcs:%.c=obj/%.o)`, "obj/a.o obj/b.o"},
+		{`$(strip  a   b  )`, "a b"},
+		{`$(findstring a,a b c) $(findstring x,a b c)`, "a "},
+		{`$(filter %.c %.s,foo.c bar.c baz.s ugh.h)`, "foo.c bar.c baz.s"},
+		{`$(filter-out %.c,foo.c bar.c baz.s ugh.h)`, "baz.s ugh.h"},
+		{`$(sort foo bar lose foo)`, "bar foo lose"},
+		{`$(word 2, foo bar baz) $(word 4,foo)`, "bar "},
+		{`$(words foo bar baz)`, "3"},
+		{`$(firstword foo bar) $(lastword foo bar)`, "foo bar"},
+		{`$(dir src/foo.c hacks)`, "src/ ./"},
+		{`$(notdir src/foo.c hacks)`, "foo.c hacks"},
+		{`$(suffix src/foo.c src-1.0/bar.c hacks)`, ".c .c"},
+		{`$(basename src/foo.c src-1.0/bar hacks)`, "src/foo src-1.0/bar hacks"},
+		{`$(addsuffix .c,foo bar)`, "foo.c bar.c"},
+		{`$(addprefix src/,foo bar)`, "src/foo src/bar"},
+		{`$(wildcard *.go)`, "a.go b.go"},
+		{`$(wildcard dir/*.go c.txt missing.txt)`, "dir/d.go c.txt"},
+		{`$(foreach f,a b c,<$(f)>)`, "<a> <b> <c>"},
+		{`$(if $(srcs),yes,no) $(if $(undefined),yes,no) $(if ,yes)`, "yes no "},
+		{`$(call pair,a,b)`, "a-b"},
+		{`$(call addprefix,x,a b)`, "xa xb"},
+		{`$(shell echo a; echo b)`, "a b"},
+		{`$(notdir $(patsubst %.c,%.o,$(srcs)))`, "a.o b.o"},
+	}
+	for _, test := range tests {
+		x := &expander{vars: vars, conf: conf}
+		got, err := x.expand(test.input)
+		if err != nil {
+			t.Errorf("%s: %s", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestExpander_funcErrors(t *testing.T) {
+	tests := []string{
+		`$(subst a,b)`,
+		`$(word 0,a b)`,
+		`$(error oops)`,
+	}
+	for _, input := range tests {
+		x := &expander{}
+		if _, err := x.expand(input); err == nil {
+			t.Errorf("%s: got no error, want error", input)
+		}
+	}
+}
+
+func TestConfig_Funcs(t *testing.T) {
+	conf := &Config{Funcs: map[string]Func{
+		"repo-dir": func(args []string) (string, error) {
+			return "repos/" + strings.Join(args, "/"), nil
+		},
+		"fail": func(args []string) (string, error) {
+			return "", errors.New("oops")
+		},
+	}}
+
+	mf, err := conf.Parse([]byte(`
+dir := $(repo-dir foo)
+all: $(repo-dir a,b) $(call repo-dir,c)
+	echo $(repo-dir $@)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mf.Vars["dir"].Value, "repos/foo"; got != want {
+		t.Errorf("got dir %q, want %q", got, want)
+	}
+	rule := mf.Rule("all")
+	if got, want := rule.Prereqs(), []string{"repos/a/b", "repos/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got prereqs %v, want %v", got, want)
+	}
+	if got, err := conf.NewMaker(mf, "all").expandRecipe(rule, rule.Recipes()[0]); err != nil {
+		t.Error(err)
+	} else if want := "echo repos/all"; got != want {
+		t.Errorf("got recipe %q, want %q", got, want)
+	}
+
+	if _, err := conf.Parse([]byte("x := $(fail a)\n")); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("got error %v, want error from function", err)
+	}
+}
+
+func TestMaker_Run_wildcardInRecipe(t *testing.T) {
+	// The recipe for list is expanded after gen is made, so $(wildcard) sees
+	// the files that gen creates.
+	const makefile = `
+list: gen
+	echo $(wildcard out/*.txt) > $(DIR)/list
+gen:
+	mkdir -p $(DIR)/out && touch $(DIR)/out/a.txt $(DIR)/out/b.txt
+`
+	conf, _, _, err := runMakefile(t, Config{}, makefile, "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := conf.fs().Open("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "out/a.txt out/b.txt\n"; got != want {
+		t.Errorf("got list %q, want %q", got, want)
+	}
+}
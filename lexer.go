@@ -0,0 +1,75 @@
+package makex
+
+import (
+	"bytes"
+	"strings"
+)
+
+// splitLines splits the contents of a Makefile into physical lines.
+func splitLines(data []byte) []string {
+	return strings.Split(string(data), "\n")
+}
+
+// makefileLine returns the logical line that begins at lines[0] (which is not
+// a recipe line), and the number of physical lines it spans. As in GNU make,
+// each backslash-newline, along with the whitespace around it, is replaced by
+// a single space.
+func makefileLine(lines []string) (line string, n int) {
+	line, n = lines[0], 1
+	for continues(line) && n < len(lines) {
+		line = strings.TrimRight(line[:len(line)-1], " \t") + " " + strings.TrimLeft(lines[n], " \t")
+		n++
+	}
+	return line, n
+}
+
+// recipeLine returns the recipe that begins at lines[0] (which begins with a
+// tab), and the number of physical lines it spans. As in GNU make, the
+// backslash-newlines in a recipe are passed to the shell unchanged, except
+// that the tab at the beginning of each continuation line is removed.
+func recipeLine(lines []string) (recipe string, n int) {
+	recipe, n = strings.TrimPrefix(lines[0], "\t"), 1
+	for continues(recipe) && n < len(lines) {
+		recipe += "\n" + strings.TrimPrefix(lines[n], "\t")
+		n++
+	}
+	return recipe, n
+}
+
+// continues returns whether line ends with a backslash-newline (i.e., an odd
+// number of backslashes), which means that it continues on the next line.
+func continues(line string) bool {
+	n := len(line) - len(strings.TrimRight(line, `\`))
+	return n%2 == 1
+}
+
+// stripComment removes the comment (beginning with "#") from a line that is
+// not a recipe line. A "#" preceded by a backslash is a literal "#". As in
+// GNU make, the backslashes before a "#" escape each other, so "\\#" is a
+// literal backslash followed by a comment.
+func stripComment(line string) string {
+	if !strings.Contains(line, "#") {
+		return line
+	}
+	var b bytes.Buffer
+	last := 0
+	for i := 0; i < len(line); i++ {
+		if line[i] != '#' {
+			continue
+		}
+		start := i
+		for start > last && line[start-1] == '\\' {
+			start--
+		}
+		backslashes := i - start
+		b.WriteString(line[last:start])
+		b.WriteString(strings.Repeat(`\`, backslashes/2))
+		if backslashes%2 == 0 {
+			return b.String()
+		}
+		b.WriteByte('#')
+		last = i + 1
+	}
+	b.WriteString(line[last:])
+	return b.String()
+}
@@ -0,0 +1,58 @@
+package makex
+
+import "testing"
+
+func TestMakefileLine(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  string
+		wantN int
+	}{
+		{[]string{"a", "b"}, "a", 1},
+		{[]string{`a \`, "  b", "c"}, "a b", 2},
+		{[]string{`a\`, `\`, "\tb"}, "a b", 3},
+		{[]string{`a \\`, "b"}, `a \\`, 1},
+		{[]string{`a \`}, `a \`, 1},
+	}
+	for _, test := range tests {
+		line, n := makefileLine(test.lines)
+		if line != test.want || n != test.wantN {
+			t.Errorf("%q: got %q (%d lines), want %q (%d lines)", test.lines, line, n, test.want, test.wantN)
+		}
+	}
+}
+
+func TestRecipeLine(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  string
+		wantN int
+	}{
+		{[]string{"\ta", "\tb"}, "a", 1},
+		{[]string{"\ta \\", "\t\tb", "\tc"}, "a \\\n\tb", 2},
+		{[]string{"\ta\\", "b"}, "a\\\nb", 2},
+	}
+	for _, test := range tests {
+		recipe, n := recipeLine(test.lines)
+		if recipe != test.want || n != test.wantN {
+			t.Errorf("%q: got %q (%d lines), want %q (%d lines)", test.lines, recipe, n, test.want, test.wantN)
+		}
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := map[string]string{
+		"a":            "a",
+		"a # b":        "a ",
+		"# a":          "",
+		`a \# b`:       "a # b",
+		`a \\# b`:      `a \`,
+		`a \\\# b # c`: `a \# b `,
+		`a\b # c`:      `a\b `,
+	}
+	for line, want := range tests {
+		if got := stripComment(line); got != want {
+			t.Errorf("%q: got %q, want %q", line, got, want)
+		}
+	}
+}
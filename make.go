@@ -1,13 +1,14 @@
 package makex
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
-
-	"github.com/neelance/parallel"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // NewMaker creates a new Maker, which can build goals in a Makefile.
@@ -16,6 +17,8 @@ func (c *Config) NewMaker(mf *Makefile, goals ...string) *Maker {
 		mf:     mf,
 		goals:  goals,
 		cycles: make(map[string][]string),
+		deps:   make(map[string][]string),
+		rules:  make(map[string]Rule),
 		Config: c,
 	}
 	m.buildDAG()
@@ -31,6 +34,18 @@ type Maker struct {
 	topo   [][]string
 	cycles map[string][]string
 
+	// deps maps each target to its prereqs that have rules.
+	deps map[string][]string
+
+	// state is the state database read from StateFile (see loadState).
+	state     *buildState
+	stateErr  error
+	stateOnce sync.Once
+
+	// rules caches the rule (explicit or implicit) to make each target
+	// that has been looked up.
+	rules map[string]Rule
+
 	// RuleOutput specifies the writers to receive the stdout and stderr output
 	// from executing a rule's recipes. After executing a rule, out and err are
 	// closed. If RuleOutput is nil, os.Stdout and
@@ -43,6 +58,10 @@ type Maker struct {
 	Started, Ended, Succeeded chan<- Rule
 	Failed                    chan<- RuleBuildError
 
+	// Skipped, if non-nil, receives the rules that were not run because
+	// one of their prereqs failed to build (in KeepGoing mode).
+	Skipped chan<- Rule
+
 	*Config
 }
 
@@ -66,17 +85,17 @@ func (m *Maker) buildDAG() {
 			}
 			seen[target] = struct{}{}
 
-			rule := m.mf.Rule(target)
+			rule := m.rule(target)
 			if rule == nil {
 				// ignore targets that don't have
 				// rules, but don't error out.
 				continue
 			}
-			prereqs := uniqAndSort(rule.Prereqs())
+			prereqs := uniqAndSort(append([]string{}, rule.Prereqs()...))
 			prereqsWithRules := []string{}
 			for _, dep := range prereqs {
 				// don't process dependencies that don't have rules
-				if m.mf.Rule(dep) == nil {
+				if m.rule(dep) == nil {
 					continue
 				}
 				prereqsWithRules = append(prereqsWithRules, dep)
@@ -87,6 +106,7 @@ func (m *Maker) buildDAG() {
 				}
 			}
 			dag[target] = prereqsWithRules
+			m.deps[target] = append([]string{}, prereqsWithRules...)
 		}
 		queue = queue[origLen:]
 	}
@@ -140,6 +160,111 @@ func (m *Maker) buildDAG() {
 	}
 }
 
+// rule returns the rule to make target. If target has no explicit rule, the
+// first pattern rule that can make it is used. If target's explicit rule is a
+// plain rule with no recipes (such as "foo.o: foo.h"), the pattern rule is
+// used with the explicit rule's prereqs added after its own, as in GNU make.
+// If no rule can make target, rule returns nil.
+func (m *Maker) rule(target string) Rule {
+	if rule, cached := m.rules[target]; cached {
+		return rule
+	}
+	rule := m.mf.Rule(target)
+	if _, ok := rule.(*DoubleColonRule); ok {
+		rule = doubleColonRules(m.mf.DoubleColonRules(target))
+	}
+	explicit, _ := rule.(*BasicRule)
+	needsRecipe := rule == nil || (explicit != nil && len(explicit.RecipeCmds) == 0)
+	if needsRecipe && !isPhony(m, target) {
+		if implicit := m.implicitRule(target, nil); implicit != nil {
+			if explicit != nil {
+				prereqs := append([]string(nil), implicit.PrereqFiles...)
+				for _, p := range explicit.Prereqs() {
+					if !contains(prereqs, p) {
+						prereqs = append(prereqs, p)
+					}
+				}
+				implicit.PrereqFiles = prereqs
+			}
+			rule = implicit
+		}
+	}
+	m.rules[target] = rule
+	return rule
+}
+
+// doubleColonRules is the Rule used by Maker to make a target that has
+// double-colon rules. Its prereqs and recipes are those of all of its rules.
+type doubleColonRules []*DoubleColonRule
+
+func (r doubleColonRules) Target() string { return r[0].Target() }
+
+func (r doubleColonRules) Prereqs() []string {
+	var prereqs []string
+	for _, rule := range r {
+		prereqs = append(prereqs, rule.Prereqs()...)
+	}
+	return uniqAndSort(prereqs)
+}
+
+func (r doubleColonRules) Recipes() []string {
+	var recipes []string
+	for _, rule := range r {
+		recipes = append(recipes, rule.Recipes()...)
+	}
+	return recipes
+}
+
+// implicitRule returns a rule to make target created from the pattern rule
+// with the shortest stem whose prereqs all exist or can be made, or nil if
+// there is no such pattern rule. Pattern rules in chain (which are already
+// being used to make targets that depend on target) are not considered, so
+// that chains of implicit rules are finite.
+func (m *Maker) implicitRule(target string, chain map[*PatternRule]bool) *ImplicitRule {
+	var candidates []*ImplicitRule
+	for _, pr := range m.mf.PatternRules() {
+		if chain[pr] {
+			continue
+		}
+		if stem, ok := pr.Match(target); ok {
+			candidates = append(candidates, pr.Instantiate(target, stem))
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(candidates[i].Stem()) < len(candidates[j].Stem())
+	})
+
+	for _, rule := range candidates {
+		chain2 := map[*PatternRule]bool{rule.Pattern: true}
+		for pr := range chain {
+			chain2[pr] = true
+		}
+		canMake := true
+		for _, p := range rule.Prereqs() {
+			if !m.canMake(p, chain2) {
+				canMake = false
+				break
+			}
+		}
+		if canMake {
+			return rule
+		}
+	}
+	return nil
+}
+
+// canMake returns whether target exists or can be made by an explicit rule or
+// a chain of implicit rules.
+func (m *Maker) canMake(target string, chain map[*PatternRule]bool) bool {
+	if m.mf.Rule(target) != nil {
+		return true
+	}
+	if exists, _ := m.pathExists(target); exists {
+		return true
+	}
+	return m.implicitRule(target, chain) != nil
+}
+
 // TargetSets returns a topologically sorted list of sets of target
 // names. To only get targets that are stale and need to be built, use
 // TargetSetsNeedingBuild.
@@ -147,11 +272,52 @@ func (m *Maker) TargetSets() [][]string {
 	return m.topo
 }
 
+// UpToDate returns whether all of the Maker's goals are up to date, which
+// means that Run would not run any recipes.
+func (m *Maker) UpToDate() (bool, error) {
+	targetSets, err := m.TargetSetsNeedingBuild()
+	if err != nil {
+		return false, err
+	}
+	return len(targetSets) == 0, nil
+}
+
 // TargetSetsNeedingBuild returns a topologically sorted list of sets
 // of target names that need to be built (i.e., that are stale).
 func (m *Maker) TargetSetsNeedingBuild() ([][]string, error) {
+	staleSets, err := m.StaleTargetSets()
+	if err != nil {
+		return nil, err
+	}
+	targetSets := make([][]string, len(staleSets))
+	for i, staleSet := range staleSets {
+		targetSets[i] = make([]string, len(staleSet))
+		for j, stale := range staleSet {
+			targetSets[i][j] = stale.Target
+		}
+	}
+	return targetSets, nil
+}
+
+// A StaleTarget is a target that needs to be built, along with the reason
+// why.
+type StaleTarget struct {
+	Target string
+
+	// Reason is a short description of why Target is stale, such as
+	// `prereq "foo.c" is newer than target "foo.o"`.
+	Reason string
+}
+
+func (t StaleTarget) String() string {
+	return t.Target + ": " + t.Reason
+}
+
+// StaleTargetSets is like TargetSetsNeedingBuild, but it also returns the
+// reason why each target needs to be built.
+func (m *Maker) StaleTargetSets() ([][]StaleTarget, error) {
 	for _, goal := range m.goals {
-		if rule := m.mf.Rule(goal); rule == nil {
+		if rule := m.rule(goal); rule == nil {
 			return nil, errNoRuleToMakeTarget(goal)
 		}
 		if deps, isCycle := m.cycles[goal]; isCycle {
@@ -159,75 +325,193 @@ func (m *Maker) TargetSetsNeedingBuild() ([][]string, error) {
 		}
 	}
 
-	targetSets := make([][]string, 0)
+	staleSets := make([][]StaleTarget, 0)
 	for _, targetSet := range m.topo {
-		var targetsNeedingBuild []string
+		var staleSet []StaleTarget
 		for _, target := range targetSet {
-			// Always build .PHONY target
-			if isPhony(m, target) {
-				targetsNeedingBuild = append(targetsNeedingBuild, target)
-				continue
-			}
-			exists, err := m.pathExists(target)
+			stale, reason, err := m.needsBuild(target)
 			if err != nil {
 				return nil, err
 			}
-			// Always build the target if it doesn't
-			// exist.
-			if !exists {
-				targetsNeedingBuild = append(targetsNeedingBuild, target)
-				continue
+			if stale {
+				staleSet = append(staleSet, StaleTarget{Target: target, Reason: reason})
 			}
-			// The target needs to be built if the mtime
-			// of one of the target's files is greater
-			// than the mtime of the target.
-			targetModTime, err := m.modTime(target)
+		}
+		if len(staleSet) > 0 {
+			staleSets = append(staleSets, staleSet)
+		}
+	}
+	return staleSets, nil
+}
+
+// needsBuild returns whether target is stale and needs to be built, and if
+// so, the reason why.
+func (m *Maker) needsBuild(target string) (bool, string, error) {
+	// Never build targets that are assumed to be old or new.
+	if m.assumedOld(target) || m.assumedNew(target) {
+		return false, "", nil
+	}
+
+	// Always build .PHONY target
+	if isPhony(m, target) {
+		return true, "target is phony", nil
+	}
+	rule := m.rule(target)
+	if rule == nil {
+		return false, "", errNoRuleToMakeTarget(target)
+	}
+	if missing, err := m.missingIntermediate(target); err != nil {
+		return false, "", err
+	} else if missing {
+		return m.intermediateNeeded(target)
+	}
+	if rules, ok := rule.(doubleColonRules); ok {
+		stale, reason, err := m.staleDoubleColonRules(rules)
+		return len(stale) > 0, reason, err
+	}
+	return m.ruleNeedsBuild(rule)
+}
+
+// ruleNeedsBuild returns whether rule's target is stale, and if so, the
+// reason why. The targets of a GroupedRule are all made at once, so they are
+// all stale if any one of them is.
+//
+// The AlwaysMake, AssumeOld, and AssumeNew options and phony prereqs are
+// handled here; otherwise, the Maker's StalenessChecker decides. Intermediate
+// prereqs that don't exist are replaced by their own prereqs.
+func (m *Maker) ruleNeedsBuild(rule Rule) (bool, string, error) {
+	if m.AlwaysMake {
+		return true, "all targets are forced to be remade", nil
+	}
+	prereqs, bypassed, err := m.bypassIntermediates(rule.Prereqs(), true)
+	if err != nil {
+		return false, "", err
+	}
+	if bypassed {
+		rule = bypassedRule{rule, prereqs}
+	}
+	for _, p := range prereqs {
+		if m.assumedOld(p) {
+			continue
+		}
+		if isPhony(m, p) {
+			return true, fmt.Sprintf("prereq %q is phony", p), nil
+		}
+		if m.assumedNew(p) {
+			return true, fmt.Sprintf("prereq %q is assumed to be new", p), nil
+		}
+	}
+	return m.staleness().NeedsBuild(rule)
+}
+
+// executor returns the Executor to use.
+func (m *Maker) executor() Executor {
+	if m.Executor != nil {
+		return m.Executor
+	}
+	return ShellExecutor{}
+}
+
+// staleness returns the StalenessChecker to use.
+func (m *Maker) staleness() StalenessChecker {
+	if m.Staleness != nil {
+		return m.Staleness
+	}
+	if m.StateFile != "" {
+		return hashChecker{m}
+	}
+	return ModTimeChecker{m.Config}
+}
+
+// recordBuild notifies the StalenessChecker (if it is a BuildRecorder) that
+// rules' targets were made.
+func (m *Maker) recordBuild(rules []Rule) error {
+	recorder, ok := m.staleness().(BuildRecorder)
+	if !ok {
+		return nil
+	}
+	for _, rule := range rules {
+		if err := recorder.RecordBuild(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assumedOld returns whether target is in AssumeOld, which means that it is
+// never rebuilt and does not cause the targets that depend on it to be
+// rebuilt.
+func (m *Maker) assumedOld(target string) bool {
+	return contains(m.AssumeOld, target)
+}
+
+// assumedNew returns whether target is in AssumeNew, which means that it is
+// treated as newer than every other file.
+func (m *Maker) assumedNew(target string) bool {
+	return contains(m.AssumeNew, target)
+}
+
+// staleDoubleColonRules returns the double-colon rules for a target whose
+// recipes need to be run, and the reason why the first of them is stale.
+// Each rule is checked independently, and a rule with no prereqs is always
+// run.
+func (m *Maker) staleDoubleColonRules(rules doubleColonRules) (stale []Rule, reason string, err error) {
+	for _, rule := range rules {
+		var needsBuild bool
+		var ruleReason string
+		switch {
+		case len(rule.Prereqs()) == 0:
+			needsBuild, ruleReason = true, "double-colon rule has no prereqs"
+		case isPhony(m, rule.Target()):
+			needsBuild, ruleReason = true, "target is phony"
+		default:
+			needsBuild, ruleReason, err = m.ruleNeedsBuild(rule)
 			if err != nil {
-				return nil, err
-			}
-			rule := m.mf.Rule(target)
-			if rule == nil {
-				return nil, errNoRuleToMakeTarget(target)
-			}
-			for _, p := range rule.Prereqs() {
-				if isPhony(m, p) {
-					targetsNeedingBuild = append(targetsNeedingBuild, target)
-					break
-				}
-				m, err := m.modTime(p)
-				if err != nil {
-					return nil, err
-				}
-				if m.After(targetModTime) {
-					targetsNeedingBuild = append(targetsNeedingBuild, target)
-					break
-				}
+				return nil, "", err
 			}
 		}
-		if len(targetsNeedingBuild) > 0 {
-			targetSets = append(targetSets, targetsNeedingBuild)
+		if needsBuild {
+			if len(stale) == 0 {
+				reason = ruleReason
+			}
+			stale = append(stale, rule)
 		}
 	}
-	return targetSets, nil
+	return stale, reason, nil
+}
+
+// recipeRules returns the rules whose recipes must be run to make the target
+// of rule. This is just rule, except for targets with double-colon rules.
+func (m *Maker) recipeRules(rule Rule) ([]Rule, error) {
+	if rules, ok := rule.(doubleColonRules); ok {
+		stale, _, err := m.staleDoubleColonRules(rules)
+		return stale, err
+	}
+	return []Rule{rule}, nil
 }
 
 // DryRun prints information about what targets *would* be built if Run() was
-// called.
+// called. If Explain is set, the reason why each target would be built is
+// also printed.
 func (m *Maker) DryRun(w io.Writer) error {
-	targetSets, err := m.TargetSetsNeedingBuild()
+	staleSets, err := m.StaleTargetSets()
 	if err != nil {
 		return err
 	}
-	if len(targetSets) == 0 {
+	if len(staleSets) == 0 {
 		fmt.Fprintln(w, "No target sets need building.")
 	}
-	for i, targetSet := range targetSets {
+	for i, staleSet := range staleSets {
 		if i != 0 {
 			fmt.Fprintln(w)
 		}
-		fmt.Fprintf(w, "========= TARGET SET %d (%d targets)\n", i, len(targetSet))
-		for _, target := range targetSet {
-			fmt.Fprintln(w, " - ", target)
+		fmt.Fprintf(w, "========= TARGET SET %d (%d targets)\n", i, len(staleSet))
+		for _, stale := range staleSet {
+			if m.Explain {
+				fmt.Fprintf(w, " -  %s (%s)\n", stale.Target, stale.Reason)
+			} else {
+				fmt.Fprintln(w, " - ", stale.Target)
+			}
 		}
 	}
 	return nil
@@ -242,91 +526,516 @@ func (m *Maker) ruleOutput(r Rule) (stdout io.WriteCloser, stderr io.WriteCloser
 	return nopCloser{os.Stdout}, nopCloser{os.Stderr}, log.New(os.Stderr, fmt.Sprintf("%s: ", r.Target()), 0)
 }
 
-// Run builds all stale targets.
+// Run builds all stale targets. Each target is started as soon as all of its
+// prereqs have been built, with at most ParallelJobs rules running at once.
+// If a rule fails, no more rules are started (unless KeepGoing is set), and
+// Run returns after the rules that are already running have finished. A failed
+// rule's targets are removed (unless they are .PRECIOUS), and intermediate
+// files are removed after the build.
+//
+// Each recipe line may begin with any of the prefixes "@" (don't log the
+// command, even if Verbose is set), "-" (ignore the command's exit status),
+// and "+" (run the command even if DryRun is set). If DryRun is set, the
+// other commands are written to the rule's stdout instead of being run.
 func (m *Maker) Run() error {
+	return m.RunContext(context.Background())
+}
+
+// RunContext is like Run, but stops building when ctx is done. The recipes
+// that are running are killed (along with any processes they started), their
+// targets are removed (unless they are .PRECIOUS), and RunContext returns
+// ctx.Err().
+func (m *Maker) RunContext(ctx context.Context) error {
 	targetSets, err := m.TargetSetsNeedingBuild()
 	if err != nil {
 		return err
 	}
+	stale := make(map[string]bool)
+	for _, targetSet := range targetSets {
+		for _, target := range targetSet {
+			stale[target] = true
+		}
+	}
 
-	for i, targetSet := range targetSets {
-		m.logTargetSetStart(i, targetSet)
-		par := parallel.NewRun(m.ParallelJobs)
+	// waiting holds the number of each target's prereqs that have not been
+	// made yet, and dependents maps each target to the targets that have
+	// it as a prereq. Targets that are not stale are still visited, so
+	// that their dependents wait for any stale targets they depend on.
+	waiting := make(map[string]int)
+	dependents := make(map[string][]string)
+	var ready []string
+	for _, targetSet := range m.topo {
 		for _, target := range targetSet {
-			rule := m.mf.Rule(target)
-			par.Acquire()
-			go func() {
-				defer par.Release()
+			waiting[target] = len(m.deps[target])
+			for _, prereq := range m.deps[target] {
+				dependents[prereq] = append(dependents[prereq], target)
+			}
+			if waiting[target] == 0 {
+				ready = append(ready, target)
+			}
+		}
+	}
+	finish := func(target string) {
+		for _, dependent := range dependents[target] {
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
 
-				stdout, stderr, log := m.ruleOutput(rule)
-				if m.Started != nil {
-					m.Started <- rule
+	jobs := m.ParallelJobs
+	if _, notParallel := specialPrereqs(m, ".NOTPARALLEL"); notParallel || jobs < 1 {
+		jobs = 1
+	}
+	type result struct {
+		rule Rule
+		err  error
+	}
+	results := make(chan result)
+	running := 0
+
+	// building maps the rules that are running (identified by their first
+	// target) to the targets they will make, built holds the rules that
+	// have finished, and failed holds those that failed. A grouped rule is
+	// only run once for all of its targets.
+	building := make(map[string][]string)
+	built := make(map[string]bool)
+	failed := make(map[string]bool)
+
+	// made holds the targets that were made successfully.
+	var made []string
+
+	// In KeepGoing mode, the targets that depend on a failed target are
+	// skipped. They never become ready, because the failed target is never
+	// finished, but the stale ones are reported (once per rule).
+	skipped := make(map[string]bool)
+	skippedRules := make(map[string]bool)
+	var skip func(target string)
+	skip = func(target string) {
+		for _, dependent := range dependents[target] {
+			if skipped[dependent] {
+				continue
+			}
+			skipped[dependent] = true
+			if rule := m.rule(dependent); stale[dependent] && !skippedRules[rule.Target()] {
+				skippedRules[rule.Target()] = true
+				if m.Skipped != nil {
+					m.Skipped <- rule
 				}
-				defer stdout.Close()
-				defer stderr.Close()
-				defer func() {
-					if m.Ended != nil {
-						m.Ended <- rule
-					}
-				}()
+			}
+			skip(dependent)
+		}
+	}
 
-				for _, recipe := range rule.Recipes() {
-					recipe = ExpandAutoVars(rule, recipe)
-					if m.Verbose {
-						log.Printf("running command: %s", recipe)
-					}
-					cmd := exec.Command("sh", "-c", recipe)
-					cmd.Stdout, cmd.Stderr = stdout, stderr
-
-					err := cmd.Run()
-					if err != nil {
-						// remove files if failed
-						if exists, _ := m.pathExists(rule.Target()); exists {
-							err2 := m.fs().Remove(rule.Target())
-							if err2 != nil {
-								log.Printf("failed to remove target after error: %s", err)
-							}
-						}
-
-						log.Printf(`command failed: %s (%s)`, recipe, err)
-						err2 := RuleBuildError{rule, fmt.Errorf("command failed: %s (%s)", recipe, err)}
-						if m.Failed != nil {
-							m.Failed <- err2
-						}
-						par.Error(err2)
-						return
-					}
+	var errs Errors
+	for {
+		for len(ready) > 0 && running < jobs && (errs == nil || m.KeepGoing) && ctx.Err() == nil {
+			target := ready[0]
+			ready = ready[1:]
+			if !stale[target] {
+				finish(target)
+				continue
+			}
+			rule := m.rule(target)
+			key := rule.Target()
+			if targets, ok := building[key]; ok {
+				building[key] = append(targets, target)
+				continue
+			}
+			if failed[key] {
+				// In KeepGoing mode, another target of a
+				// failed grouped rule may become ready later.
+				skip(target)
+				continue
+			}
+			if built[key] {
+				finish(target)
+				continue
+			}
+			building[key] = []string{target}
+			running++
+			go func() {
+				results <- result{rule, m.runRule(ctx, rule)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+
+		res := <-results
+		running--
+		key := res.rule.Target()
+		targets := building[key]
+		delete(building, key)
+		built[key] = true
+		if res.err != nil {
+			errs = append(errs, res.err)
+			failed[key] = true
+			for _, target := range targets {
+				skip(target)
+			}
+			continue
+		}
+		for _, target := range targets {
+			made = append(made, target)
+			finish(target)
+		}
+	}
+	if !m.Config.DryRun {
+		if err := m.removeIntermediates(made); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// Touch marks all stale targets as up to date, in topological order, by
+// updating their mtimes (or creating them) instead of running their recipes.
+// As in GNU make, phony targets and targets whose rules have no recipes are
+// not touched.
+func (m *Maker) Touch() error {
+	targetSets, err := m.TargetSetsNeedingBuild()
+	if err != nil {
+		return err
+	}
+	touched := make(map[string]bool)
+	for _, targetSet := range targetSets {
+		for _, target := range targetSet {
+			if touched[target] || isPhony(m, target) {
+				continue
+			}
+			rule := m.rule(target)
+			recipeRules, err := m.recipeRules(rule)
+			if err != nil {
+				return err
+			}
+			_, hasRecipes := rule.(FuncRule)
+			for _, rule := range recipeRules {
+				if len(rule.Recipes()) > 0 {
+					hasRecipes = true
 				}
+			}
+			if !hasRecipes {
+				continue
+			}
+			// Touch all of the targets of a grouped rule.
+			for _, target := range ruleTargets(rule) {
+				if err := m.touch(target); err != nil {
+					return err
+				}
+				touched[target] = true
+			}
+			if err := m.recordBuild(recipeRules); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runRule runs the recipes of rule (or, if it is a FuncRule, its Run method).
+// If ctx is done, the recipe that is running
+// is killed, and runRule returns ctx.Err().
+func (m *Maker) runRule(ctx context.Context, rule Rule) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	recipeRules, err := m.recipeRules(rule)
+	if err != nil {
+		return err
+	}
 
-				if m.Succeeded != nil {
-					m.Succeeded <- rule
+	stdout, stderr, log := m.ruleOutput(rule)
+	if m.Started != nil {
+		m.Started <- rule
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+	defer func() {
+		if m.Ended != nil {
+			m.Ended <- rule
+		}
+	}()
+
+	// fail removes rule's targets after one of its recipes failed (or was
+	// interrupted), unless they are precious, and returns the error. what
+	// describes the failure (such as "command failed: cmd").
+	fail := func(recipeRule Rule, what string, err error) error {
+		for _, target := range ruleTargets(rule) {
+			if isPrecious(m, target) {
+				continue
+			}
+			if exists, _ := m.pathExists(target); exists {
+				err2 := m.fs().Remove(target)
+				if err2 != nil {
+					log.Printf("failed to remove target after error: %s", err)
 				}
-			}()
+			}
 		}
-		err := par.Wait()
-		if err != nil {
-			return Errors(err.(parallel.Errors))
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Printf(`%s (%s)`, what, err)
+		err2 := RuleBuildError{
+			Rule: rule,
+			Pos:  m.mf.Pos(recipeRule),
+			Err:  fmt.Errorf("%s (%s)", what, err),
+		}
+		if m.Failed != nil {
+			m.Failed <- err2
 		}
+		return err2
 	}
 
+	if funcRule, ok := rule.(FuncRule); ok {
+		err = m.runFunc(ctx, funcRule, stdout, stderr, log, fail)
+	} else {
+		err = m.runRecipes(ctx, rule, recipeRules, stdout, stderr, log, fail)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !m.Config.DryRun {
+		if err := m.recordBuild(recipeRules); err != nil {
+			return err
+		}
+	}
+
+	if m.Succeeded != nil {
+		m.Succeeded <- rule
+	}
 	return nil
 }
 
-func (m *Maker) logTargetSetStart(idx int, targetSet []string) {
+// runFunc calls the Run method of rule, which is a FuncRule, unless DryRun
+// is set. fail is called to clean up (and report) a failure.
+func (m *Maker) runFunc(ctx context.Context, rule FuncRule, stdout, stderr io.Writer, log *log.Logger, fail func(Rule, string, error) error) error {
+	if m.Config.DryRun {
+		return nil
+	}
 	if m.Verbose {
-		if idx != 0 {
-			fmt.Fprintln(os.Stderr)
+		log.Printf("running recipe function")
+	}
+	err := rule.Run(ctx, &RuleContext{
+		Target:  rule.Target(),
+		Targets: ruleTargets(rule),
+		Prereqs: rule.Prereqs(),
+		Stdout:  stdout,
+		Stderr:  stderr,
+		Log:     log,
+		FS:      m.fs(),
+	})
+	if err != nil {
+		return fail(rule, "recipe function failed", err)
+	}
+	return nil
+}
+
+// runRecipes runs the commands in the recipes of rule's recipeRules with the
+// Executor. If DryRun is set, the commands are written to stdout instead
+// (except for those beginning with "+"). fail is called to clean up (and
+// report) a failure.
+func (m *Maker) runRecipes(ctx context.Context, rule Rule, recipeRules []Rule, stdout, stderr io.Writer, log *log.Logger, fail func(Rule, string, error) error) error {
+	shell, err := m.shell(rule)
+	if err != nil {
+		return fail(rule, "expanding SHELL and .SHELLFLAGS", err)
+	}
+	env := os.Environ()
+	dir, err := os.Getwd()
+	if err != nil {
+		return fail(rule, "getting working directory", err)
+	}
+	for _, recipeRule := range recipeRules {
+		commands, err := m.recipeCommands(rule, recipeRule)
+		if err != nil {
+			return fail(recipeRule, "expanding recipe", err)
+		}
+		for _, c := range commands {
+			if m.Config.DryRun && !c.always {
+				// Print the command instead of running it.
+				fmt.Fprintln(stdout, c.command)
+				continue
+			}
+			if m.Verbose && !c.silent {
+				log.Printf("running command: %s", c.command)
+			}
+			err := m.executor().Execute(ctx, rule, &Command{
+				Recipe: c.command,
+				Shell:  shell,
+				Env:    env,
+				Dir:    dir,
+				Stdout: stdout,
+				Stderr: stderr,
+			})
+			if err != nil && c.ignoreErrors && ctx.Err() == nil {
+				log.Printf(`command failed: %s (%s) (ignored)`, c.command, err)
+				continue
+			}
+			if err != nil {
+				return fail(recipeRule, "command failed: "+c.command, err)
+			}
+		}
+	}
+	return nil
+}
+
+// shell returns the program and arguments used to run rule's recipes, to which
+// each command is appended. The program is the value of the SHELL variable and
+// the arguments are the words in .SHELLFLAGS (which default to "-c"), as
+// defined in the Makefile or as target-specific variables of rule's targets.
+// If the Makefile defines neither, Config.Shell is used (or, if it is empty,
+// "sh -c").
+//
+// As in GNU make, the SHELL environment variable is never used.
+func (m *Maker) shell(rule Rule) ([]string, error) {
+	targetVars := m.mf.ruleVars(rule)
+	lookup := func(name string) (string, bool, error) {
+		v, ok := targetVars[name]
+		if !ok {
+			v, ok = m.mf.Vars[name]
+		}
+		if !ok || v.Simple {
+			return v.Value, ok, nil
+		}
+		x := expander{vars: m.mf.Vars, conf: m.Config, locals: targetVars}
+		value, err := x.expand(v.Value)
+		return value, true, err
+	}
+	shell, hasShell, err := lookup("SHELL")
+	if err != nil {
+		return nil, err
+	}
+	flags, hasFlags, err := lookup(".SHELLFLAGS")
+	if err != nil {
+		return nil, err
+	}
+
+	defaultShell := m.Shell
+	if len(defaultShell) == 0 {
+		defaultShell = []string{"sh", "-c"}
+	}
+	if !hasShell && !hasFlags {
+		// Return a copy, so that callers can't modify (or race on)
+		// Config.Shell.
+		return append([]string(nil), defaultShell...), nil
+	}
+	if !hasShell || strings.TrimSpace(shell) == "" {
+		shell = defaultShell[0]
+	}
+	if !hasFlags {
+		flags = "-c"
+	}
+	return append(strings.Fields(shell), strings.Fields(flags)...), nil
+}
+
+// A recipeCommand is a shell command to run for a rule, made from one of its
+// recipe lines (or, with .ONESHELL, all of them).
+type recipeCommand struct {
+	command string
+	recipePrefix
+}
+
+// recipeCommands returns the commands to run for recipeRule, which is one of
+// rule's recipe rules. If .ONESHELL is defined, all of the recipe lines are
+// run in a single shell, and only the prefixes of the first line apply. The
+// .SILENT and .IGNORE special targets apply to every command.
+func (m *Maker) recipeCommands(rule, recipeRule Rule) ([]recipeCommand, error) {
+	var commands []recipeCommand
+	for _, recipe := range recipeRule.Recipes() {
+		recipe, err := m.expandRecipe(recipeRule, recipe)
+		if err != nil {
+			return nil, err
+		}
+		var c recipeCommand
+		c.command, c.recipePrefix = parseRecipePrefix(recipe)
+		commands = append(commands, c)
+	}
+	if _, oneShell := specialPrereqs(m, ".ONESHELL"); oneShell && len(commands) > 1 {
+		lines := make([]string, len(commands))
+		for i, c := range commands {
+			lines[i] = c.command
 		}
-		fmt.Fprintf(os.Stderr, "========= TARGET SET %d (%d targets)\n", idx, len(targetSet))
+		commands = []recipeCommand{{strings.Join(lines, "\n"), commands[0].recipePrefix}}
+	}
+	silent, ignoreErrors := appliesTo(m, ".SILENT", rule), appliesTo(m, ".IGNORE", rule)
+	for i := range commands {
+		commands[i].silent = commands[i].silent || silent
+		commands[i].ignoreErrors = commands[i].ignoreErrors || ignoreErrors
+	}
+	return commands, nil
+}
+
+// A recipePrefix describes the special prefix characters at the beginning of
+// a recipe line.
+type recipePrefix struct {
+	silent       bool // "@": don't echo the command
+	ignoreErrors bool // "-": ignore a nonzero exit status
+	always       bool // "+": run the command even in dry-run mode
+}
+
+// parseRecipePrefix removes the prefix characters ("@", "-", and "+", in any
+// combination, and the whitespace around them) from the beginning of recipe.
+func parseRecipePrefix(recipe string) (string, recipePrefix) {
+	var prefix recipePrefix
+	for {
+		recipe = strings.TrimLeft(recipe, " \t")
+		if recipe == "" {
+			return recipe, prefix
+		}
+		switch recipe[0] {
+		case '@':
+			prefix.silent = true
+		case '-':
+			prefix.ignoreErrors = true
+		case '+':
+			prefix.always = true
+		default:
+			return recipe, prefix
+		}
+		recipe = recipe[1:]
 	}
 }
 
+// expandRecipe returns the shell command for one of rule's recipes. As in
+// GNU make, recipes are only expanded when their rules are run, so they see
+// the final values of variables, the target-specific variables and automatic
+// variables of their targets, and the files made by their prereqs (in
+// functions such as $(wildcard)).
+func (m *Maker) expandRecipe(rule Rule, recipe string) (string, error) {
+	x := expander{vars: m.mf.Vars, conf: m.Config, rule: rule, recipe: true, locals: m.mf.ruleVars(rule)}
+	recipe, err := x.expand(recipe)
+	if err != nil {
+		return "", err
+	}
+	return ExpandAutoVars(rule, recipe), nil
+}
+
 type RuleBuildError struct {
 	Rule Rule
-	Err  error
+
+	// Pos is the position in the Makefile of the rule whose recipe failed,
+	// if known.
+	Pos Pos
+
+	Err error
 }
 
-func (e RuleBuildError) Error() string { return e.Err.Error() }
+func (e RuleBuildError) Error() string {
+	if !e.Pos.IsValid() {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: recipe for target '%s' failed: %s", e.Pos, e.Rule.Target(), e.Err)
+}
 
 func errNoRuleToMakeTarget(target string) error {
 	return fmt.Errorf("no rule to make target %q", target)
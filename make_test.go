@@ -1,12 +1,16 @@
 package makex
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -62,6 +66,177 @@ func TestMaker_Run(t *testing.T) {
 	}
 }
 
+func TestMaker_Run_patternRule(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "x.in"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mf, err := Parse([]byte(`
+%.out: %.in
+	cd ` + filepath.ToSlash(tmpDir) + ` && cp $< $@ && echo $(addprefix $(prefix),$*) >> $@
+prefix = -
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mk := conf.NewMaker(mf, "x.out")
+	if err := mk.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "x.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "hello-x\n"; got != want {
+		t.Errorf("got target contents %q, want %q", got, want)
+	}
+}
+
+func TestMaker_Run_patternRuleWithExplicitPrereqs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+	}
+
+	for _, name := range []string{"foo.c", "foo.h"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The explicit rule has no recipe, so the pattern rule's recipe is
+	// used, with foo.h added to its prereqs.
+	mf, err := Parse([]byte(`
+foo.o: foo.h
+%.o: %.c
+	cd ` + filepath.ToSlash(tmpDir) + ` && cp $< $@ && echo $^ >> $@
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mk := conf.NewMaker(mf, "foo.o")
+	if err := mk.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "foo.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "foo.cfoo.c foo.h\n"; got != want {
+		t.Errorf("got target contents %q, want %q", got, want)
+	}
+}
+
+func TestMaker_Run_groupedRule(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{
+		ParallelJobs: 2,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+	}
+
+	dir := filepath.ToSlash(tmpDir)
+	mf := &Makefile{
+		Rules: []Rule{
+			&GroupedRule{
+				TargetFiles: []string{"x0", "x1"},
+				RecipeCmds:  []string{"echo >> " + dir + "/count && touch " + dir + "/x0 " + dir + "/x1"},
+			},
+		},
+	}
+
+	mk := conf.NewMaker(mf, "x0", "x1")
+	if err := mk.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	for _, target := range []string{"x0", "x1"} {
+		if !isFile(conf.FS, target) {
+			t.Errorf("target %s does not exist after running Makefile; want it to exist", target)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "count"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(data), 1; got != want {
+		t.Errorf("got grouped rule recipes run %d times, want %d", got, want)
+	}
+}
+
+func TestMaker_Run_doubleColonRules(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+	}
+
+	now := time.Now()
+	for file, modTime := range map[string]time.Time{
+		"x":  now,
+		"y0": now.Add(-time.Hour),
+		"y1": now.Add(time.Hour),
+	} {
+		path := filepath.Join(tmpDir, file)
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	log := filepath.ToSlash(filepath.Join(tmpDir, "log"))
+	mf := &Makefile{
+		Rules: []Rule{
+			&DoubleColonRule{TargetFile: "x", PrereqFiles: []string{"y0"}, RecipeCmds: []string{"echo $^ >> " + log}},
+			&DoubleColonRule{TargetFile: "x", PrereqFiles: []string{"y1"}, RecipeCmds: []string{"echo $^ >> " + log}},
+			&DoubleColonRule{TargetFile: "x", RecipeCmds: []string{"echo none >> " + log}},
+		},
+	}
+
+	mk := conf.NewMaker(mf, "x")
+	if err := mk.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "y1\nnone\n"; got != want {
+		t.Errorf("got recipe output %q, want %q", got, want)
+	}
+}
+
 func isFile(fs rwvfs.FileSystem, file string) bool {
 	fi, err := fs.Stat(file)
 	if err != nil {
@@ -147,6 +322,8 @@ func TestTargetsNeedingBuild(t *testing.T) {
 		mf    *Makefile
 		fs    FileSystem
 		goals []string
+		// conf holds the options to use (other than FS).
+		conf Config
 		// If afterMake is set, the test will run 'make' once,
 		// call afterMake with fs, and then check the test
 		// conditions.
@@ -158,6 +335,41 @@ func TestTargetsNeedingBuild(t *testing.T) {
 			mf: &Makefile{},
 			wantTargetSetsNeedingBuild: [][]string{},
 		},
+		"always make": {
+			mf:    &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x"}}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x": ""})),
+			goals: []string{"x"},
+			conf:  Config{AlwaysMake: true},
+			wantTargetSetsNeedingBuild: [][]string{{"x"}},
+		},
+		"don't build target that is assumed old": {
+			mf:    &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x"}}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{})),
+			goals: []string{"x"},
+			conf:  Config{AlwaysMake: true, AssumeOld: []string{"x"}},
+			wantTargetSetsNeedingBuild: [][]string{},
+		},
+		"don't build target because of prereq that is assumed old": {
+			mf: &Makefile{Rules: []Rule{
+				&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}},
+				&BasicRule{TargetFile: "y"},
+				&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"y"}},
+			}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x": ""})),
+			goals: []string{"x"},
+			conf:  Config{AssumeOld: []string{"y"}},
+			wantTargetSetsNeedingBuild: [][]string{},
+		},
+		"build target because of prereq that is assumed new": {
+			mf: &Makefile{Rules: []Rule{
+				&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}},
+				&BasicRule{TargetFile: "y"},
+			}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x": "", "y": ""})),
+			goals: []string{"x"},
+			conf:  Config{AssumeNew: []string{"y"}},
+			wantTargetSetsNeedingBuild: [][]string{{"x"}},
+		},
 		"return error if target isn't defined in Makefile": {
 			mf:      &Makefile{},
 			goals:   []string{"x"},
@@ -295,10 +507,71 @@ func TestTargetsNeedingBuild(t *testing.T) {
 			goals: []string{"all"},
 			wantTargetSetsNeedingBuild: [][]string{{"compile"}, {"all"}},
 		},
+		"build all grouped targets if one is missing": {
+			mf: &Makefile{Rules: []Rule{
+				&GroupedRule{TargetFiles: []string{"x0", "x1"}, PrereqFiles: []string{"y"}},
+			}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x0": "", "y": ""})),
+			goals: []string{"x0", "x1"},
+			wantTargetSetsNeedingBuild: [][]string{{"x0", "x1"}},
+		},
+		"build target with pattern rule": {
+			mf: &Makefile{Rules: []Rule{
+				&PatternRule{TargetPattern: "%.o", PrereqPatterns: []string{"%.c"}},
+			}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x.c": ""})),
+			goals: []string{"x.o"},
+			wantTargetSetsNeedingBuild: [][]string{{"x.o"}},
+		},
+		"return error if pattern rule prereq doesn't exist": {
+			mf: &Makefile{Rules: []Rule{
+				&PatternRule{TargetPattern: "%.o", PrereqPatterns: []string{"%.c"}},
+			}},
+			fs:      NewFileSystem(rwvfs.Map(map[string]string{})),
+			goals:   []string{"x.o"},
+			wantErr: errNoRuleToMakeTarget("x.o"),
+		},
+		"prefer explicit rule to pattern rule": {
+			mf: &Makefile{Rules: []Rule{
+				&PatternRule{TargetPattern: "%.o", PrereqPatterns: []string{"%.c"}},
+				&BasicRule{TargetFile: "x.o", PrereqFiles: []string{"y"}},
+				&BasicRule{TargetFile: "y"},
+			}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x.c": ""})),
+			goals: []string{"x.o"},
+			wantTargetSetsNeedingBuild: [][]string{{"y"}, {"x.o"}},
+		},
+		"chain pattern rules": {
+			mf: &Makefile{Rules: []Rule{
+				&PatternRule{TargetPattern: "%.o", PrereqPatterns: []string{"%.c"}},
+				&PatternRule{TargetPattern: "%.c", PrereqPatterns: []string{"%.y"}},
+			}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x.y": ""})),
+			goals: []string{"x.o"},
+			wantTargetSetsNeedingBuild: [][]string{{"x.c"}, {"x.o"}},
+		},
+		"use pattern rule whose prereqs can be made": {
+			mf: &Makefile{Rules: []Rule{
+				&PatternRule{TargetPattern: "%.o", PrereqPatterns: []string{"%.f"}},
+				&PatternRule{TargetPattern: "%.o", PrereqPatterns: []string{"%.c"}},
+			}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x.c": ""})),
+			goals: []string{"x.o"},
+			wantTargetSetsNeedingBuild: [][]string{{"x.o"}},
+		},
+		"don't chain a pattern rule to itself": {
+			mf: &Makefile{Rules: []Rule{
+				&PatternRule{TargetPattern: "%", PrereqPatterns: []string{"%.x"}},
+			}},
+			fs:      NewFileSystem(rwvfs.Map(map[string]string{})),
+			goals:   []string{"a"},
+			wantErr: errNoRuleToMakeTarget("a"),
+		},
 	}
 
 	for label, test := range tests {
-		conf := &Config{FS: test.fs}
+		conf := test.conf
+		conf.FS = test.fs
 		mk := conf.NewMaker(test.mf, test.goals...)
 		if test.afterMake != nil {
 			if err := mk.Run(); err != nil {
@@ -328,3 +601,544 @@ func TestTargetsNeedingBuild(t *testing.T) {
 		}
 	}
 }
+
+func TestMaker_Run_failedRecipe(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+	}
+	mf, err := conf.ParseFile("Makefile", []byte(`
+all: x
+x:
+	false`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mk := conf.NewMaker(mf, "all")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	err = mk.Run()
+	if err == nil {
+		t.Fatal("Run succeeded, want error")
+	}
+	if got, want := err.Error(), "Makefile:3: recipe for target 'x' failed: command failed: false (exit status 1)"; got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+}
+
+func TestMaker_Run_noTargetSetBarrier(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{
+		ParallelJobs: 2,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+	}
+
+	// slow is in the same target set as fast1, but it only finishes after
+	// fast2 (which depends on fast1) has been made.
+	dir := filepath.ToSlash(tmpDir)
+	mf, err := Parse([]byte(`
+all: slow fast2
+	touch ` + dir + `/$@
+slow:
+	for i in $$(seq 100); do test -f ` + dir + `/fast2 && touch ` + dir + `/$@ && exit 0; sleep 0.05; done; exit 1
+fast2: fast1
+	touch ` + dir + `/$@
+fast1:
+	touch ` + dir + `/$@
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mk := conf.NewMaker(mf, "all")
+	if err := mk.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	for _, target := range []string{"all", "slow", "fast1", "fast2"} {
+		if !isFile(conf.FS, target) {
+			t.Errorf("target %s does not exist after running Makefile; want it to exist", target)
+		}
+	}
+}
+
+func TestMaker_RunContext_cancel(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+	}
+	mf, err := Parse([]byte(`
+x:
+	touch ` + filepath.ToSlash(tmpDir) + `/$@ && sleep 10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mk := conf.NewMaker(mf, "x")
+	// Use writers that aren't *os.Files, so that the command isn't
+	// finished until all processes that share its output have exited.
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for !isFile(conf.FS, "x") {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+
+	start := time.Now()
+	if err := mk.RunContext(ctx); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RunContext took %s after being canceled; want the recipe to be killed", elapsed)
+	}
+	if isFile(conf.FS, "x") {
+		t.Error("target x exists after canceling; want it to be removed")
+	}
+}
+
+func TestMaker_Run_keepGoing(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dir := filepath.ToSlash(tmpDir)
+	mf, err := Parse([]byte(`
+all: bad good
+	touch ` + dir + `/$@
+bad0:
+	false
+bad: bad0
+	touch ` + dir + `/$@
+good: good0
+	touch ` + dir + `/$@
+good0:
+	touch ` + dir + `/$@
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keepGoing := range []bool{false, true} {
+		os.Remove(filepath.Join(tmpDir, "good"))
+		os.Remove(filepath.Join(tmpDir, "good0"))
+		conf := &Config{
+			ParallelJobs: 1,
+			FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+			KeepGoing:    keepGoing,
+		}
+		mk := conf.NewMaker(mf, "all")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+		skipped := make(chan Rule)
+		mk.Skipped = skipped
+		var skippedTargets []string
+		done := make(chan struct{})
+		go func() {
+			for rule := range skipped {
+				skippedTargets = append(skippedTargets, rule.Target())
+			}
+			close(done)
+		}()
+
+		err := mk.Run()
+		close(skipped)
+		<-done
+		if errs, ok := err.(Errors); !ok || len(errs) != 1 {
+			t.Errorf("KeepGoing=%v: got error %v, want 1 error", keepGoing, err)
+		}
+		if isFile(conf.FS, "all") || isFile(conf.FS, "bad") {
+			t.Errorf("KeepGoing=%v: targets that depend on the failed target exist; want them to not have been built", keepGoing)
+		}
+		if keepGoing {
+			if !isFile(conf.FS, "good") {
+				t.Errorf("KeepGoing=%v: target good does not exist; want it to have been built", keepGoing)
+			}
+			sort.Strings(skippedTargets)
+			if want := []string{"all", "bad"}; !reflect.DeepEqual(skippedTargets, want) {
+				t.Errorf("KeepGoing=%v: got skipped targets %v, want %v", keepGoing, skippedTargets, want)
+			}
+		}
+	}
+}
+
+func TestMaker_Run_keepGoingGroupedRule(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// With one job, b is still waiting to be run when the grouped rule
+	// (run for a) fails, so it must be skipped rather than treated as made.
+	dir := filepath.ToSlash(tmpDir)
+	mf, err := Parse([]byte(`
+all: c d
+a b &:
+	false
+c: a
+	touch ` + dir + `/$@
+d: b
+	touch ` + dir + `/$@
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+		KeepGoing:    true,
+	}
+	mk := conf.NewMaker(mf, "all")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	err = mk.Run()
+	if errs, ok := err.(Errors); !ok || len(errs) != 1 {
+		t.Errorf("got error %v, want 1 error", err)
+	}
+	for _, target := range []string{"c", "d"} {
+		if isFile(conf.FS, target) {
+			t.Errorf("target %s exists; want it to not have been built after its prereq's rule failed", target)
+		}
+	}
+}
+
+func TestMaker_UpToDate(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}},
+		&BasicRule{TargetFile: "y"},
+	}}
+	tests := []struct {
+		files        map[string]string
+		goal         string
+		wantUpToDate bool
+		wantErr      error
+	}{
+		{files: map[string]string{"x": "", "y": ""}, goal: "x", wantUpToDate: true},
+		{files: map[string]string{"y": ""}, goal: "x", wantUpToDate: false},
+		{files: map[string]string{"x": ""}, goal: "x", wantUpToDate: false},
+		{files: map[string]string{}, goal: "z", wantErr: errNoRuleToMakeTarget("z")},
+	}
+	for _, test := range tests {
+		conf := &Config{FS: NewFileSystem(rwvfs.Map(test.files))}
+		upToDate, err := conf.NewMaker(mf, test.goal).UpToDate()
+		if !reflect.DeepEqual(err, test.wantErr) {
+			t.Errorf("%s %v: got error %v, want %v", test.goal, test.files, err, test.wantErr)
+			continue
+		}
+		if upToDate != test.wantUpToDate {
+			t.Errorf("%s %v: got UpToDate %v, want %v", test.goal, test.files, upToDate, test.wantUpToDate)
+		}
+	}
+}
+
+func TestMaker_Touch(t *testing.T) {
+	fs := newModTimeFileSystem(rwvfs.Map(map[string]string{"x": "data"}))
+	conf := &Config{FS: fs}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}, RecipeCmds: []string{"false"}},
+		&BasicRule{TargetFile: "y", RecipeCmds: []string{"false"}},
+		&BasicRule{TargetFile: "p", RecipeCmds: []string{"false"}},
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"p"}},
+	}}
+
+	mk := conf.NewMaker(mf, "x", "p")
+	if err := mk.Touch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isFile(fs, "y") {
+		t.Error("target y does not exist after Touch; want it to be created")
+	}
+	if isFile(fs, "p") {
+		t.Error("phony target p exists after Touch; want it to not be touched")
+	}
+	if data, err := conf.readFile("x"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "data" {
+		t.Errorf("got x contents %q after Touch, want them to be unchanged", data)
+	}
+	if upToDate, err := conf.NewMaker(mf, "x").UpToDate(); err != nil {
+		t.Fatal(err)
+	} else if !upToDate {
+		t.Error("x is not up to date after Touch")
+	}
+}
+
+func TestMaker_Touch_osFileSystem(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	old := time.Now().Add(-time.Hour)
+	if err := ioutil.WriteFile("x", []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("x", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("y", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a nil FS, the file's mtime is set in place.
+	var conf Config
+	mf := &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}, RecipeCmds: []string{"false"}}}}
+	if err := conf.NewMaker(mf, "x").Touch(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().After(old) {
+		t.Errorf("got x mtime %v after Touch, want it to be updated", fi.ModTime())
+	}
+	if data, err := ioutil.ReadFile("x"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "data" {
+		t.Errorf("got x contents %q after Touch, want them to be unchanged", data)
+	}
+}
+
+func TestMaker_StaleTargetSets(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}},
+		&BasicRule{TargetFile: "y"},
+		&BasicRule{TargetFile: "z", PrereqFiles: []string{"p"}},
+		&BasicRule{TargetFile: "p"},
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"p"}},
+	}}
+	tests := []struct {
+		conf  Config
+		files map[string]string
+		goal  string
+		want  [][]StaleTarget
+	}{
+		{
+			files: map[string]string{"y": ""},
+			goal:  "x",
+			want:  [][]StaleTarget{{{"x", `target "x" does not exist`}}},
+		},
+		{
+			files: map[string]string{"x": ""},
+			goal:  "x",
+			want: [][]StaleTarget{
+				{{"y", `target "y" does not exist`}},
+				{{"x", `prereq "y" does not exist`}},
+			},
+		},
+		{
+			files: map[string]string{"z": ""},
+			goal:  "z",
+			want: [][]StaleTarget{
+				{{"p", "target is phony"}},
+				{{"z", `prereq "p" is phony`}},
+			},
+		},
+		{
+			conf:  Config{AlwaysMake: true},
+			files: map[string]string{"x": "", "y": ""},
+			goal:  "x",
+			want: [][]StaleTarget{
+				{{"y", "all targets are forced to be remade"}},
+				{{"x", "all targets are forced to be remade"}},
+			},
+		},
+		{
+			conf:  Config{AssumeNew: []string{"y"}},
+			files: map[string]string{"x": "", "y": ""},
+			goal:  "x",
+			want:  [][]StaleTarget{{{"x", `prereq "y" is assumed to be new`}}},
+		},
+		{
+			files: map[string]string{"x": "", "y": ""},
+			goal:  "x",
+			want:  [][]StaleTarget{},
+		},
+	}
+	for _, test := range tests {
+		conf := test.conf
+		conf.FS = NewFileSystem(rwvfs.Map(test.files))
+		staleSets, err := conf.NewMaker(mf, test.goal).StaleTargetSets()
+		if err != nil {
+			t.Errorf("%s %v: %s", test.goal, test.files, err)
+			continue
+		}
+		if !reflect.DeepEqual(staleSets, test.want) {
+			t.Errorf("%s %v: got stale target sets %v, want %v", test.goal, test.files, staleSets, test.want)
+		}
+	}
+}
+
+func TestMaker_DryRun_explain(t *testing.T) {
+	conf := Config{FS: NewFileSystem(rwvfs.Map(map[string]string{})), Explain: true}
+	mf := &Makefile{
+		Rules: []Rule{&BasicRule{TargetFile: "x"}},
+	}
+	var buf bytes.Buffer
+	if err := conf.NewMaker(mf, "x").DryRun(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "========= TARGET SET 0 (1 targets)\n -  x (target \"x\" does not exist)\n"
+	if buf.String() != want {
+		t.Errorf("got DryRun output %q, want %q", buf.String(), want)
+	}
+}
+
+func TestParseRecipePrefix(t *testing.T) {
+	tests := []struct {
+		recipe     string
+		wantRecipe string
+		wantPrefix recipePrefix
+	}{
+		{"echo hi", "echo hi", recipePrefix{}},
+		{"@echo hi", "echo hi", recipePrefix{silent: true}},
+		{"-rm foo", "rm foo", recipePrefix{ignoreErrors: true}},
+		{"+$(MAKE) sub", "$(MAKE) sub", recipePrefix{always: true}},
+		{"@- rm foo", "rm foo", recipePrefix{silent: true, ignoreErrors: true}},
+		{" +@-true", "true", recipePrefix{silent: true, ignoreErrors: true, always: true}},
+		{"echo -@+", "echo -@+", recipePrefix{}},
+		{"@", "", recipePrefix{silent: true}},
+	}
+	for _, test := range tests {
+		recipe, prefix := parseRecipePrefix(test.recipe)
+		if recipe != test.wantRecipe || prefix != test.wantPrefix {
+			t.Errorf("%q: got (%q, %+v), want (%q, %+v)", test.recipe, recipe, prefix, test.wantRecipe, test.wantPrefix)
+		}
+	}
+}
+
+func TestMaker_Run_recipePrefixes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{
+		ParallelJobs: 1,
+		Verbose:      true,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+	}
+	mf, err := conf.ParseFile("Makefile", []byte(`
+x:
+	-false
+	@cd `+filepath.ToSlash(tmpDir)+` && echo quiet > x
+	+cd `+filepath.ToSlash(tmpDir)+` && echo always > y
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(dryRun bool) (stdout, logOutput string) {
+		var stdoutBuf, logBuf bytes.Buffer
+		conf.DryRun = dryRun
+		mk := conf.NewMaker(mf, "x")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{&stdoutBuf}, nopCloser{ioutil.Discard}, log.New(&logBuf, "", 0)
+		}
+		if err := mk.Run(); err != nil {
+			t.Fatalf("DryRun=%v: %s", dryRun, err)
+		}
+		return stdoutBuf.String(), logBuf.String()
+	}
+
+	// In dry-run mode, only the "+" recipe is run.
+	stdout, _ := run(true)
+	if want := "false\ncd " + filepath.ToSlash(tmpDir) + " && echo quiet > x\n"; stdout != want {
+		t.Errorf("DryRun: got stdout %q, want %q", stdout, want)
+	}
+	if isFile(conf.fs(), "x") {
+		t.Error("DryRun: target x exists; want it to not be created")
+	}
+	if !isFile(conf.fs(), "y") {
+		t.Error("DryRun: file y does not exist; want the \"+\" recipe to be run")
+	}
+
+	_, logOutput := run(false)
+	if !strings.Contains(logOutput, "command failed: false (exit status 1) (ignored)") {
+		t.Errorf("got log output %q, want the failed command to be ignored", logOutput)
+	}
+	if strings.Contains(logOutput, "echo quiet") {
+		t.Errorf("got log output %q, want the \"@\" command to not be logged", logOutput)
+	}
+	if !isFile(conf.fs(), "x") {
+		t.Error("target x does not exist after Run")
+	}
+}
+
+func TestMaker_expandRecipe(t *testing.T) {
+	mf, err := Parse([]byte(`
+a = 1
+x: y
+	echo $(a) $@ $^ $$HOME
+a = 2
+z: a = 3
+z:
+	echo $(a) $@
+e:
+	echo $(error boom)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := (&Config{}).NewMaker(mf, "x")
+	tests := map[string]string{
+		"x": "echo 2 x y $HOME",
+		"z": "echo 3 z",
+	}
+	for target, want := range tests {
+		rule := mf.Rule(target)
+		recipe, err := mk.expandRecipe(rule, rule.Recipes()[0])
+		if err != nil {
+			t.Errorf("%s: %s", target, err)
+			continue
+		}
+		if recipe != want {
+			t.Errorf("%s: got recipe %q, want %q", target, recipe, want)
+		}
+	}
+
+	rule := mf.Rule("e")
+	if _, err := mk.expandRecipe(rule, rule.Recipes()[0]); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("e: got error %v, want error from $(error)", err)
+	}
+}
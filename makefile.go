@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -14,6 +15,62 @@ import (
 // Makefile represents a set of rules, each describing how to build a target.
 type Makefile struct {
 	Rules []Rule
+
+	// Vars holds the variables defined in the Makefile.
+	Vars Vars
+
+	// TargetVars maps targets to their target-specific variables (defined
+	// in lines such as "target: name = value"), which take precedence over
+	// Vars in the target's recipes. Unlike in GNU make, they are not
+	// inherited by the target's prereqs.
+	TargetVars map[string]Vars
+
+	// Includes are the makefiles that were included by the Makefile, in
+	// the order they were read.
+	Includes []Include
+
+	// pos holds the positions of the rules that were parsed from a
+	// Makefile.
+	pos map[Rule]Pos
+}
+
+// ruleVars returns the target-specific variables of rule's targets.
+func (mf *Makefile) ruleVars(rule Rule) Vars {
+	var vars Vars
+	for _, target := range ruleTargets(rule) {
+		for name, v := range mf.TargetVars[target] {
+			if vars == nil {
+				vars = make(Vars)
+			}
+			vars[name] = v
+		}
+	}
+	return vars
+}
+
+// Pos returns the position of rule in the Makefile, which is the line of the
+// rule that defined its recipes (or, if it has none, the line where its
+// target first appeared). If rule was not parsed from the Makefile, Pos
+// returns the zero Pos.
+func (mf *Makefile) Pos(rule Rule) Pos {
+	switch r := rule.(type) {
+	case *ImplicitRule:
+		rule = r.Pattern
+	case doubleColonRules:
+		if len(r) == 0 {
+			return Pos{}
+		}
+		rule = r[0]
+	}
+	return mf.pos[rule]
+}
+
+// setPos records the position of rule.
+func (mf *Makefile) setPos(rule Rule, pos Pos) {
+	if mf.pos == nil {
+		mf.pos = make(map[Rule]Pos)
+	}
+	mf.pos[rule] = pos
 }
 
 // BasicRule implements Rule.
@@ -37,20 +94,163 @@ func (r *BasicRule) Prereqs() []string { return r.PrereqFiles }
 // Recipes implements rule.
 func (r *BasicRule) Recipes() []string { return r.RecipeCmds }
 
-// Rule returns the rule to make the specified target if it exists, or nil
-// otherwise.
+// A GroupedRule is a rule with multiple targets that are all made by a single
+// invocation of its recipes (written with "&:" in a Makefile, as in GNU make).
+// Its Target method returns the first target.
+type GroupedRule struct {
+	TargetFiles []string
+	PrereqFiles []string
+	RecipeCmds  []string
+}
+
+// Target implements Rule.
+func (r *GroupedRule) Target() string { return r.TargetFiles[0] }
+
+// Targets returns all of the rule's targets.
+func (r *GroupedRule) Targets() []string { return r.TargetFiles }
+
+// Prereqs implements Rule.
+func (r *GroupedRule) Prereqs() []string { return r.PrereqFiles }
+
+// Recipes implements rule.
+func (r *GroupedRule) Recipes() []string { return r.RecipeCmds }
+
+// A DoubleColonRule is a rule written with "::" in a Makefile. A target may
+// have multiple double-colon rules, each of which is independent: its recipes
+// are run only if the target is older than one of that rule's prereqs (or if
+// the rule has no prereqs).
+type DoubleColonRule struct {
+	TargetFile  string
+	PrereqFiles []string
+	RecipeCmds  []string
+}
+
+// Target implements Rule.
+func (r *DoubleColonRule) Target() string { return r.TargetFile }
+
+// Prereqs implements Rule.
+func (r *DoubleColonRule) Prereqs() []string { return r.PrereqFiles }
+
+// Recipes implements rule.
+func (r *DoubleColonRule) Recipes() []string { return r.RecipeCmds }
+
+// ruleTargets returns all of the targets that rule makes.
+func ruleTargets(rule Rule) []string {
+	switch rule := rule.(type) {
+	case *GroupedRule:
+		return rule.Targets()
+	case bypassedRule:
+		return ruleTargets(rule.Rule)
+	}
+	return []string{rule.Target()}
+}
+
+// A PatternRule is a rule whose target contains a "%", which matches any
+// nonempty substring (the stem) of a target name. A "%" in a prereq stands for
+// the same stem. The "%" in a pattern may match across directory separators.
+type PatternRule struct {
+	TargetPattern  string
+	PrereqPatterns []string
+	RecipeCmds     []string
+}
+
+// Target implements Rule.
+func (r *PatternRule) Target() string { return r.TargetPattern }
+
+// Prereqs implements Rule.
+func (r *PatternRule) Prereqs() []string { return r.PrereqPatterns }
+
+// Recipes implements rule.
+func (r *PatternRule) Recipes() []string { return r.RecipeCmds }
+
+// Match returns the stem of target if target matches the rule's target
+// pattern. If it doesn't match, ok is false.
+func (r *PatternRule) Match(target string) (stem string, ok bool) {
+	i := strings.Index(r.TargetPattern, "%")
+	if i == -1 {
+		return "", false
+	}
+	prefix, suffix := r.TargetPattern[:i], r.TargetPattern[i+1:]
+	if len(target) <= len(prefix)+len(suffix) || !strings.HasPrefix(target, prefix) || !strings.HasSuffix(target, suffix) {
+		return "", false
+	}
+	return target[len(prefix) : len(target)-len(suffix)], true
+}
+
+// Instantiate returns a rule to make target, whose prereqs are the rule's
+// prereq patterns with their "%" replaced by stem.
+func (r *PatternRule) Instantiate(target, stem string) *ImplicitRule {
+	prereqs := make([]string, len(r.PrereqPatterns))
+	for i, p := range r.PrereqPatterns {
+		prereqs[i] = strings.Replace(p, "%", stem, 1)
+	}
+	return &ImplicitRule{
+		BasicRule: BasicRule{TargetFile: target, PrereqFiles: prereqs, RecipeCmds: r.RecipeCmds},
+		Pattern:   r,
+		stem:      stem,
+	}
+}
+
+// An ImplicitRule is a rule created from a PatternRule to make a specific
+// target.
+type ImplicitRule struct {
+	BasicRule
+
+	// Pattern is the pattern rule that the rule was created from.
+	Pattern *PatternRule
+
+	stem string
+}
+
+// Stem returns the part of the target that matched the "%" in the pattern
+// rule's target. It is the value of the automatic variable $*.
+func (r *ImplicitRule) Stem() string { return r.stem }
+
+// Rule returns the explicit rule to make the specified target if it exists,
+// or nil otherwise. It does not consider pattern rules. If the target has
+// double-colon rules, the first one is returned; use DoubleColonRules to get
+// all of them.
 //
-// TODO(sqs): support multiple rules for one target
-// (http://www.gnu.org/software/make/manual/html_node/Multiple-Rules.html).
+// A target should have at most one other rule; Parse merges the prereqs of
+// multiple rules for the same target into a single rule.
 func (mf *Makefile) Rule(target string) Rule {
 	for _, rule := range mf.Rules {
-		if rule.Target() == target {
-			return rule
+		if _, isPattern := rule.(*PatternRule); isPattern {
+			continue
+		}
+		for _, t := range ruleTargets(rule) {
+			if t == target {
+				return rule
+			}
 		}
 	}
 	return nil
 }
 
+// DoubleColonRules returns all of the double-colon rules for target, in the
+// order they were defined.
+func (mf *Makefile) DoubleColonRules(target string) []*DoubleColonRule {
+	var rules []*DoubleColonRule
+	for _, rule := range mf.Rules {
+		if rule, ok := rule.(*DoubleColonRule); ok && rule.Target() == target {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// PatternRules returns the pattern rules in the Makefile, in the order they
+// were defined.
+func (mf *Makefile) PatternRules() []*PatternRule {
+	var rules []*PatternRule
+	for _, rule := range mf.Rules {
+		if rule, ok := rule.(*PatternRule); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
 // A Rule describes a target file, a list of commands (recipes) used
 // to create the target output file, and the files (which may also
 // have corresponding rules) that must exist prior to running the
@@ -64,10 +264,13 @@ type Rule interface {
 	Recipes() []string
 }
 
-// DefaultRule is the first rule whose name does not begin with a ".", or nil if
-// no such rule exists.
+// DefaultRule is the first rule whose name does not begin with a "." and that
+// is not a pattern rule, or nil if no such rule exists.
 func (mf *Makefile) DefaultRule() Rule {
 	for _, rule := range mf.Rules {
+		if _, isPattern := rule.(*PatternRule); isPattern {
+			continue
+		}
 		target := rule.Target()
 		if !strings.HasPrefix(target, ".") {
 			return rule
@@ -77,21 +280,49 @@ func (mf *Makefile) DefaultRule() Rule {
 }
 
 // Expand returns a clone of mf with Prereqs filepath globs expanded. If rules
-// contain globs, they are replaced with BasicRules with the globs expanded.
+// contain globs, they are replaced with BasicRules (or GroupedRules or
+// DoubleColonRules, for rules of those types) with the globs expanded. Pattern
+// rules and FuncRules are left as-is.
 //
 // Only globs containing "*" are detected.
 func (c *Config) Expand(orig *Makefile) (*Makefile, error) {
-	var mf Makefile
+	mf := Makefile{Vars: orig.Vars, TargetVars: orig.TargetVars, Includes: orig.Includes}
 	mf.Rules = make([]Rule, len(orig.Rules))
 	for i, rule := range orig.Rules {
+		_, isPattern := rule.(*PatternRule)
+		if _, isFunc := rule.(FuncRule); isPattern || isFunc {
+			mf.Rules[i] = rule
+			if pos, ok := orig.pos[rule]; ok {
+				mf.setPos(rule, pos)
+			}
+			continue
+		}
 		expandedPrereqs, err := c.globs(rule.Prereqs())
 		if err != nil {
 			return nil, err
 		}
-		mf.Rules[i] = &BasicRule{
-			TargetFile:  rule.Target(),
-			PrereqFiles: expandedPrereqs,
-			RecipeCmds:  rule.Recipes(),
+		switch rule := rule.(type) {
+		case *GroupedRule:
+			mf.Rules[i] = &GroupedRule{
+				TargetFiles: rule.Targets(),
+				PrereqFiles: expandedPrereqs,
+				RecipeCmds:  rule.Recipes(),
+			}
+		case *DoubleColonRule:
+			mf.Rules[i] = &DoubleColonRule{
+				TargetFile:  rule.Target(),
+				PrereqFiles: expandedPrereqs,
+				RecipeCmds:  rule.Recipes(),
+			}
+		default:
+			mf.Rules[i] = &BasicRule{
+				TargetFile:  rule.Target(),
+				PrereqFiles: expandedPrereqs,
+				RecipeCmds:  rule.Recipes(),
+			}
+		}
+		if pos, ok := orig.pos[rule]; ok {
+			mf.setPos(mf.Rules[i], pos)
 		}
 	}
 	return &mf, nil
@@ -134,45 +365,131 @@ func globPrefix(path string) string {
 	return filepath.Join(prefix...)
 }
 
-// ExpandAutoVars expands the automatic variables $@ (the current target path)
-// and $^ (the space-separated list of prereqs) in s.
+// ExpandAutoVars expands the automatic variables $@ (the current target path),
+// $^ (the space-separated list of prereqs), $< (the first prereq), and $* (the
+// stem, if rule was created from a pattern rule) in s. It also unescapes "$$"
+// to a literal "$".
 func ExpandAutoVars(rule Rule, s string) string {
-	s = strings.Replace(s, "$@", Quote(rule.Target()), -1)
-	s = strings.Replace(s, "$^", strings.Join(QuoteList(rule.Prereqs()), " "), -1)
-
-	var firstPrereq string
-	if len(rule.Prereqs()) > 0 {
-		firstPrereq = Quote(rule.Prereqs()[0])
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch c := s[i+1]; {
+		case c == '$':
+			b.WriteByte('$')
+			i++
+		case isAutoVar(string(c)):
+			b.WriteString(autoVar(rule, c))
+			i++
+		default:
+			b.WriteByte('$')
+		}
 	}
-	s = strings.Replace(s, "$<", firstPrereq, -1)
+	return b.String()
+}
 
-	return s
+// isAutoVar returns whether name is the name of an automatic variable.
+func isAutoVar(name string) bool {
+	return len(name) == 1 && strings.Contains("@^<*", name)
+}
+
+// autoVar returns the value of the automatic variable named c for rule.
+func autoVar(rule Rule, c byte) string {
+	switch c {
+	case '@':
+		return Quote(rule.Target())
+	case '^':
+		return strings.Join(QuoteList(rule.Prereqs()), " ")
+	case '<':
+		if len(rule.Prereqs()) > 0 {
+			return Quote(rule.Prereqs()[0])
+		}
+	case '*':
+		if rule, ok := rule.(interface {
+			Stem() string
+		}); ok {
+			return Quote(rule.Stem())
+		}
+	}
+	return ""
 }
 
 // Marshal returns the textual representation of the Makefile, in the
 // usual format:
 //
+//   VAR = value
+//   ...
+//
 //   target: prereqs
 //   	recipes
 //
 //   ...
 //
+// Recipes are written unexpanded, as they were parsed, so the output can be
+// parsed again to produce an equivalent Makefile.
 func Marshal(mf *Makefile) ([]byte, error) {
 	var b bytes.Buffer
 
+	names := make([]string, 0, len(mf.Vars))
+	for name := range mf.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := mf.Vars[name]
+		if v.Simple {
+			fmt.Fprintf(&b, "%s := %s\n", name, strings.Replace(v.Value, "$", "$$", -1))
+		} else {
+			fmt.Fprintf(&b, "%s = %s\n", name, v.Value)
+		}
+	}
+	targets := make([]string, 0, len(mf.TargetVars))
+	for target := range mf.TargetVars {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		names := make([]string, 0, len(mf.TargetVars[target]))
+		for name := range mf.TargetVars[target] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			v := mf.TargetVars[target][name]
+			if v.Simple {
+				fmt.Fprintf(&b, "%s: %s := %s\n", target, name, strings.Replace(v.Value, "$", "$$", -1))
+			} else {
+				fmt.Fprintf(&b, "%s: %s = %s\n", target, name, v.Value)
+			}
+		}
+	}
+	if (len(names) > 0 || len(targets) > 0) && len(mf.Rules) > 0 {
+		fmt.Fprintln(&b)
+	}
+
 	for i, rule := range mf.Rules {
 		if i != 0 {
 			fmt.Fprintln(&b)
 		}
 
-		ruleName := rule.Target()
-		fmt.Fprintf(&b, "%s:", ruleName)
+		switch rule := rule.(type) {
+		case *GroupedRule:
+			fmt.Fprintf(&b, "%s &:", strings.Join(rule.Targets(), " "))
+		case *DoubleColonRule:
+			fmt.Fprintf(&b, "%s::", rule.Target())
+		default:
+			fmt.Fprintf(&b, "%s:", rule.Target())
+		}
 		for _, prereq := range rule.Prereqs() {
 			fmt.Fprintf(&b, " %s", prereq)
 		}
 		fmt.Fprintln(&b)
 		for _, recipe := range rule.Recipes() {
-			fmt.Fprintf(&b, "\t%s\n", recipe)
+			// Indent continuation lines, as is conventional (the parser removes
+			// the tab).
+			fmt.Fprintf(&b, "\t%s\n", strings.Replace(recipe, "\n", "\n\t", -1))
 		}
 	}
 
@@ -210,9 +527,9 @@ func QuoteList(ss []string) []string {
 
 // Targets returns the list of targets defined by rules.
 func Targets(rules []Rule) []string {
-	targets := make([]string, len(rules))
-	for i, rule := range rules {
-		targets[i] = rule.Target()
+	targets := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		targets = append(targets, ruleTargets(rule)...)
 	}
 	return targets
 }
@@ -21,11 +21,37 @@ func TestMarshal(t *testing.T) {
 			makefile: `
 myTarget: myPrereq0 myPrereq1
 	foo bar
+`,
+		},
+		{
+			rules: []Rule{
+				&GroupedRule{
+					[]string{"myTarget0", "myTarget1"},
+					[]string{"myPrereq"},
+					[]string{"foo bar"},
+				},
+			},
+			makefile: `
+myTarget0 myTarget1 &: myPrereq
+	foo bar
+`,
+		},
+		{
+			rules: []Rule{
+				&DoubleColonRule{"myTarget", []string{"myPrereq0"}, []string{"foo"}},
+				&DoubleColonRule{"myTarget", []string{"myPrereq1"}, []string{"bar"}},
+			},
+			makefile: `
+myTarget:: myPrereq0
+	foo
+
+myTarget:: myPrereq1
+	bar
 `,
 		},
 	}
 	for _, test := range tests {
-		makefile, err := Marshal(&Makefile{test.rules})
+		makefile, err := Marshal(&Makefile{Rules: test.rules})
 		if err != nil {
 			t.Error(err)
 			continue
@@ -56,6 +82,16 @@ func TestExpandAutoVars(t *testing.T) {
 			input: "$<",
 			want:  "",
 		},
+		{
+			rule:  (&PatternRule{TargetPattern: "%.o", PrereqPatterns: []string{"%.c", "h"}}).Instantiate("a/b.o", "a/b"),
+			input: "$@ : $^ : $< : $*",
+			want:  "a/b.o : a/b.c h : a/b.c : a/b",
+		},
+		{
+			rule:  &BasicRule{TargetFile: "x"},
+			input: "echo $$@ $@ $$$$ $HOME",
+			want:  "echo $@ x $$ $HOME",
+		},
 	}
 	for _, test := range tests {
 		got := ExpandAutoVars(test.rule, test.input)
@@ -64,3 +100,27 @@ func TestExpandAutoVars(t *testing.T) {
 		}
 	}
 }
+
+func TestPatternRule_Match(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		target   string
+		wantStem string
+		wantOK   bool
+	}{
+		{"%.o", "a.o", "a", true},
+		{"%.o", "dir/a.o", "dir/a", true},
+		{"lib%.a", "libfoo.a", "foo", true},
+		{"%.o", ".o", "", false},
+		{"%.o", "a.c", "", false},
+		{"%", "a", "a", true},
+		{"a.o", "a.o", "", false},
+	}
+	for _, test := range tests {
+		rule := &PatternRule{TargetPattern: test.pattern}
+		stem, ok := rule.Match(test.target)
+		if stem != test.wantStem || ok != test.wantOK {
+			t.Errorf("%q.Match(%q): got (%q, %v), want (%q, %v)", test.pattern, test.target, stem, ok, test.wantStem, test.wantOK)
+		}
+	}
+}
@@ -1,50 +1,561 @@
 package makex
 
 import (
-	"bytes"
 	"fmt"
 	"sort"
 	"strings"
 )
 
-// Parse parses a Makefile into a *Makefile struct.
-//
-// TODO(sqs): super hacky.
+// Parse parses a Makefile into a *Makefile struct. Included makefiles are
+// read from the current directory; use (*Config).Parse to read them from a
+// different FileSystem.
 func Parse(data []byte) (*Makefile, error) {
-	var mf Makefile
-
-	lines := bytes.Split(data, []byte{'\n'})
-	var rule *BasicRule
-	for lineno, lineBytes := range lines {
-		line := string(lineBytes)
-		if strings.HasPrefix(line, "\t") {
-			if rule == nil {
-				return nil, fmt.Errorf("line %d: indented recipe not inside a rule", lineno)
+	var c Config
+	return c.Parse(data)
+}
+
+// Parse parses a Makefile into a *Makefile struct, reading any makefiles it
+// includes from c's FileSystem. It is equivalent to ParseFile with an empty
+// filename.
+func (c *Config) Parse(data []byte) (*Makefile, error) {
+	return c.ParseFile("", data)
+}
+
+// ParseFile parses a Makefile into a *Makefile struct, reading any makefiles
+// it includes from c's FileSystem. The filename is used in positions and
+// errors (of type *ParseError) to refer to the Makefile.
+//
+// Variables are expanded in rule targets and prereqs as each rule is read.
+// Recipes are left unexpanded; as in GNU make, they are expanded by the Maker
+// when their rules are run.
+//
+// It is not an error for an included makefile to be missing if the Makefile
+// has a rule to make it; use ParseAndRemake to make such makefiles.
+func (c *Config) ParseFile(filename string, data []byte) (*Makefile, error) {
+	p := parser{mf: &Makefile{}, conf: c, file: filename}
+
+	if err := p.parse(data); err != nil {
+		return nil, err
+	}
+	if err := p.checkIncludesExist(); err != nil {
+		return nil, err
+	}
+
+	return p.mf, nil
+}
+
+// parse parses the lines of a Makefile (or an included makefile).
+func (p *parser) parse(data []byte) error {
+	condDepth := len(p.conds)
+	lines := splitLines(data)
+	for i := 0; i < len(lines); {
+		p.lineno, p.text = i+1, lines[i]
+		var err error
+		if strings.HasPrefix(lines[i], "\t") && p.rules != nil {
+			recipe, n := recipeLine(lines[i:])
+			i += n
+			err = p.parseRecipeLine(recipe)
+		} else {
+			line, n := makefileLine(lines[i:])
+			i += n
+			err = p.parseLine(stripComment(line))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return p.checkConditionalsClosed(condDepth)
+}
+
+// A parser holds the state of a Makefile being parsed.
+type parser struct {
+	mf   *Makefile
+	conf *Config
+
+	// file, lineno, and text are the name of the makefile being parsed and
+	// the (one-based) number and text of the current line.
+	file   string
+	lineno int
+	text   string
+
+	// rulePos is the position of the most recent rule line.
+	rulePos Pos
+
+	// rules are the rules (defined on the same line) whose recipes are
+	// being read, or nil if the current line is not in a rule context.
+	rules []Rule
+
+	// hadRecipes holds the rules in rules whose recipes were already
+	// defined in an earlier rule line for the same target.
+	hadRecipes map[Rule]bool
+
+	// explicit maps each target to its (first) non-pattern rule.
+	explicit map[string]Rule
+
+	// conds is the stack of conditional blocks (ifeq, etc.) that the
+	// current line is in.
+	conds []*conditional
+
+	// including is the stack of makefiles being included, which is used to
+	// detect recursive includes.
+	including []string
+}
+
+// parseRecipeLine parses a line that begins with a tab in a rule context,
+// which is a recipe line. Recipe lines are passed to the shell unchanged (so
+// "#" does not begin a comment).
+func (p *parser) parseRecipeLine(recipe string) error {
+	if p.skipping() {
+		return nil
+	}
+	for _, rule := range p.rules {
+		if p.hadRecipes[rule] {
+			return p.errorf("target %q has recipes in more than one rule", rule.Target())
+		}
+		if len(rule.Recipes()) == 0 {
+			// The rule that defines a target's recipes is the most
+			// useful position to report for it.
+			p.mf.setPos(rule, p.rulePos)
+		}
+		appendRecipe(rule, recipe)
+	}
+	return nil
+}
+
+// parseLine parses a logical line that is not a recipe line, after its
+// comment has been removed.
+func (p *parser) parseLine(line string) error {
+	// Conditional directives may appear in recipes if they are not
+	// indented with a tab, and they do not end the rule context.
+	if ok, err := p.parseConditional(line); ok || err != nil {
+		return err
+	}
+	if p.skipping() {
+		return nil
+	}
+
+	// Blank lines and comments may appear among a rule's recipe lines, and
+	// they do not end the rule context.
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+
+	if name, op, value, ok := splitAssignment(line); ok {
+		p.rules = nil
+		return p.assign(name, op, value)
+	}
+
+	if strings.HasPrefix(line, "\t") {
+		return p.errorfAt(1, "indented recipe not inside a rule")
+	}
+
+	if ok, err := p.parseInclude(line); ok || err != nil {
+		p.rules = nil
+		return err
+	}
+
+	if sep := indexUnquoted(line, ':'); sep != -1 {
+		if rest := line[sep+1:]; !strings.HasPrefix(rest, ":") && !strings.HasSuffix(line[:sep], "&") {
+			if name, op, value, ok := splitAssignment(rest); ok {
+				p.rules = nil
+				return p.assignTarget(line[:sep], name, op, value)
+			}
+		}
+		switch {
+		case strings.HasSuffix(line[:sep], "&"):
+			return p.parseRule(line[:sep-1], line[sep+1:], sepGrouped)
+		case strings.HasPrefix(line[sep+1:], ":"):
+			return p.parseRule(line[:sep], line[sep+2:], sepDoubleColon)
+		default:
+			return p.parseRule(line[:sep], line[sep+1:], sepSingleColon)
+		}
+	}
+
+	p.rules = nil
+	return nil
+}
+
+// Separators between a rule's targets and prereqs.
+const (
+	sepSingleColon = ":"
+	sepDoubleColon = "::"
+	sepGrouped     = "&:"
+)
+
+// parseRule parses a rule line, whose targets and prereqs are separated by
+// sep.
+//
+// A single-colon rule with multiple targets is equivalent to a separate rule
+// for each target. If a target already has a single-colon rule, the prereqs
+// are added to that rule (and it is an error for more than one of the rules to
+// have recipes). A grouped rule's targets are all made by a single invocation
+// of its recipes. A target may have many double-colon rules, which are each
+// run independently.
+func (p *parser) parseRule(targetText, prereqText, sep string) error {
+	x := p.expander()
+	targetText, err := x.expand(targetText)
+	if err != nil {
+		return p.errorf("%s", err)
+	}
+	prereqText, err = x.expand(prereqText)
+	if err != nil {
+		return p.errorf("%s", err)
+	}
+
+	targets := strings.Fields(targetText)
+	if len(targets) == 0 {
+		return p.errorf("missing target")
+	}
+	prereqs := strings.Fields(prereqText)
+
+	p.rules = nil
+	p.hadRecipes = nil
+	p.rulePos = p.pos()
+	if strings.Contains(targetText, "%") {
+		if len(targets) > 1 {
+			return p.errorf("pattern rule with multiple targets is not yet implemented")
+		}
+		// The order of a pattern rule's prereqs is significant, because the
+		// first one is the value of $<.
+		p.addRule(&PatternRule{TargetPattern: targets[0], PrereqPatterns: prereqs})
+		return nil
+	}
+	prereqs = uniqAndSort(prereqs)
+
+	switch sep {
+	case sepGrouped:
+		for _, target := range targets {
+			if p.explicit[target] != nil {
+				return p.errorf("target %q has both grouped and other rules", target)
 			}
-			recipe := strings.TrimPrefix(line, "\t")
-			recipe = ExpandAutoVars(rule, recipe)
-			rule.RecipeCmds = append(rule.RecipeCmds, recipe)
-		} else if strings.Contains(line, ":") {
-			sep := strings.Index(line, ":")
-			targets := strings.Fields(line[:sep])
-			if len(targets) > 1 {
-				return nil, errMultipleTargetsUnsupported(lineno)
+		}
+		p.addRule(&GroupedRule{TargetFiles: targets, PrereqFiles: prereqs})
+
+	case sepDoubleColon:
+		for _, target := range targets {
+			if _, ok := p.explicit[target].(*DoubleColonRule); !ok && p.explicit[target] != nil {
+				return p.errorf("target %q has both : and :: rules", target)
 			}
-			target := targets[0]
-			prereqs := strings.Fields(line[sep+1:])
-			prereqs = uniqAndSort(prereqs)
-			rule = &BasicRule{TargetFile: target, PrereqFiles: prereqs}
-			mf.Rules = append(mf.Rules, rule)
-		} else {
-			rule = nil
+			p.addRule(&DoubleColonRule{TargetFile: target, PrereqFiles: append([]string{}, prereqs...)})
+		}
+
+	case sepSingleColon:
+		for _, target := range targets {
+			switch rule := p.explicit[target].(type) {
+			case nil:
+				p.addRule(&BasicRule{TargetFile: target, PrereqFiles: append([]string{}, prereqs...)})
+			case *BasicRule:
+				rule.PrereqFiles = uniqAndSort(append(rule.PrereqFiles, prereqs...))
+				p.reopenRule(rule)
+			case *GroupedRule:
+				rule.PrereqFiles = uniqAndSort(append(rule.PrereqFiles, prereqs...))
+				p.reopenRule(rule)
+			case *DoubleColonRule:
+				return p.errorf("target %q has both : and :: rules", target)
+			}
+		}
+	}
+	return nil
+}
+
+// addRule adds a new rule to the Makefile and makes it the current rule.
+func (p *parser) addRule(rule Rule) {
+	p.mf.Rules = append(p.mf.Rules, rule)
+	p.mf.setPos(rule, p.rulePos)
+	p.rules = append(p.rules, rule)
+	if _, isPattern := rule.(*PatternRule); isPattern {
+		return
+	}
+	if p.explicit == nil {
+		p.explicit = make(map[string]Rule)
+	}
+	for _, target := range ruleTargets(rule) {
+		if p.explicit[target] == nil {
+			p.explicit[target] = rule
+		}
+	}
+}
+
+// reopenRule makes an existing rule (whose target appeared in another rule
+// line) the current rule, so that subsequent recipes are added to it.
+func (p *parser) reopenRule(rule Rule) {
+	for _, r := range p.rules {
+		if r == rule {
+			// Already current (e.g., for "x x: y").
+			return
 		}
 	}
+	p.rules = append(p.rules, rule)
+	if len(rule.Recipes()) > 0 {
+		if p.hadRecipes == nil {
+			p.hadRecipes = make(map[Rule]bool)
+		}
+		p.hadRecipes[rule] = true
+	}
+}
+
+// appendRecipe adds a recipe to a rule being parsed.
+func appendRecipe(rule Rule, recipe string) {
+	switch rule := rule.(type) {
+	case *BasicRule:
+		rule.RecipeCmds = append(rule.RecipeCmds, recipe)
+	case *GroupedRule:
+		rule.RecipeCmds = append(rule.RecipeCmds, recipe)
+	case *DoubleColonRule:
+		rule.RecipeCmds = append(rule.RecipeCmds, recipe)
+	case *PatternRule:
+		rule.RecipeCmds = append(rule.RecipeCmds, recipe)
+	}
+}
+
+// Assignment operators.
+const (
+	opRecursive   = "="
+	opSimple      = ":="
+	opPOSIXSimple = "::="
+	opConditional = "?="
+	opAppend      = "+="
+	opShell       = "!="
+)
+
+// splitAssignment splits a variable assignment line into the variable name,
+// the assignment operator, and the value. If line is not a variable
+// assignment, ok is false.
+func splitAssignment(line string) (name, op, value string, ok bool) {
+	eq := indexUnquoted(line, '=')
+	if eq == -1 {
+		return "", "", "", false
+	}
+	lhs := line[:eq]
+	switch {
+	case strings.HasSuffix(lhs, "::"):
+		op = opPOSIXSimple
+	case strings.HasSuffix(lhs, ":"):
+		op = opSimple
+	case strings.HasSuffix(lhs, "?"):
+		op = opConditional
+	case strings.HasSuffix(lhs, "+"):
+		op = opAppend
+	case strings.HasSuffix(lhs, "!"):
+		op = opShell
+	default:
+		op = opRecursive
+	}
+	lhs = lhs[:len(lhs)-len(op)+1]
+
+	// A ":" before the operator means that this is a rule, not an
+	// assignment.
+	if strings.Contains(lhs, ":") {
+		return "", "", "", false
+	}
+	name = strings.TrimSpace(lhs)
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return "", "", "", false
+	}
+	return name, op, strings.TrimLeft(line[eq+1:], " \t"), true
+}
 
-	return &mf, nil
+// assign defines a variable, expanding its name and (if necessary) its
+// value.
+func (p *parser) assign(name, op, value string) error {
+	if p.mf.Vars == nil {
+		p.mf.Vars = make(Vars)
+	}
+	return p.assignIn(p.mf.Vars, name, op, value)
 }
 
-func errMultipleTargetsUnsupported(lineno int) error {
-	return fmt.Errorf("line %d: rule with multiple targets is yet implemented", lineno)
+// assignTarget defines a target-specific variable (in a line such as
+// "targets: name op value") for each of the targets.
+func (p *parser) assignTarget(targetText, name, op, value string) error {
+	targetText, err := p.expander().expand(targetText)
+	if err != nil {
+		return p.errorf("%s", err)
+	}
+	targets := strings.Fields(targetText)
+	if len(targets) == 0 {
+		return p.errorf("missing target")
+	}
+	for _, target := range targets {
+		if strings.Contains(target, "%") {
+			return p.errorf("pattern-specific variables are not yet implemented")
+		}
+		if p.mf.TargetVars == nil {
+			p.mf.TargetVars = make(map[string]Vars)
+		}
+		vars := p.mf.TargetVars[target]
+		if vars == nil {
+			vars = make(Vars)
+			p.mf.TargetVars[target] = vars
+		}
+		if err := p.assignIn(vars, name, op, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignIn defines a variable in vars, which is either the Makefile's
+// variables or a target's target-specific variables. The operators that
+// depend on a variable's current value (such as "+=") use its value in vars,
+// or if it is not defined there, its global value.
+func (p *parser) assignIn(vars Vars, name, op, value string) error {
+	x := p.expander()
+	name, err := x.expand(name)
+	if err != nil {
+		return p.errorf("%s", err)
+	}
+	lookup := func(name string) (Var, bool) {
+		if v, ok := vars[name]; ok {
+			return v, true
+		}
+		return p.mf.Vars.lookup(name)
+	}
+
+	switch op {
+	case opRecursive:
+		vars[name] = Var{Value: value}
+
+	case opSimple, opPOSIXSimple:
+		value, err = x.expand(value)
+		if err != nil {
+			return p.errorf("%s", err)
+		}
+		vars[name] = Var{Value: value, Simple: true}
+
+	case opConditional:
+		if _, defined := lookup(name); !defined {
+			vars[name] = Var{Value: value}
+		}
+
+	case opAppend:
+		v, defined := lookup(name)
+		if !defined {
+			vars[name] = Var{Value: value}
+			break
+		}
+		if v.Simple {
+			value, err = x.expand(value)
+			if err != nil {
+				return p.errorf("%s", err)
+			}
+		}
+		if v.Value != "" {
+			value = v.Value + " " + value
+		}
+		vars[name] = Var{Value: value, Simple: v.Simple}
+
+	case opShell:
+		value, err = x.expand(value)
+		if err != nil {
+			return p.errorf("%s", err)
+		}
+		value, err = shellOutput(value)
+		if err != nil {
+			return p.errorf("%s", err)
+		}
+		vars[name] = Var{Value: value}
+	}
+	return nil
+}
+
+func (p *parser) expander() *expander {
+	return &expander{vars: p.mf.Vars, conf: p.conf}
+}
+
+// pos returns the position of the current line.
+func (p *parser) pos() Pos {
+	return Pos{File: p.file, Line: p.lineno}
+}
+
+// errorf returns a *ParseError for the current line.
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return p.errorfAt(0, format, a...)
+}
+
+// errorfAt returns a *ParseError for the given (one-based) column of the
+// current line, or for the whole line if col is 0.
+func (p *parser) errorfAt(col int, format string, a ...interface{}) error {
+	return &ParseError{
+		File:    p.file,
+		Line:    p.lineno,
+		Column:  col,
+		Snippet: p.text,
+		Err:     fmt.Errorf(format, a...),
+	}
+}
+
+// columnOf returns the (one-based) column where s first appears in the
+// current line, or 0 if it does not appear.
+func (p *parser) columnOf(s string) int {
+	return strings.Index(p.text, s) + 1
+}
+
+// A Pos is a position in a Makefile.
+type Pos struct {
+	// File is the name of the makefile, which is empty if the Makefile was
+	// parsed without a filename.
+	File string
+
+	// Line is the line number, starting at 1.
+	Line int
+}
+
+// IsValid returns whether the position is known.
+func (p Pos) IsValid() bool { return p.Line > 0 }
+
+func (p Pos) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("line %d", p.Line)
+	}
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+// A ParseError is an error in the syntax or contents of a Makefile.
+type ParseError struct {
+	// File is the name of the makefile, which is empty if the Makefile was
+	// parsed without a filename.
+	File string
+
+	// Line and Column are the (one-based) position of the error. Column
+	// is 0 if the error applies to the whole line.
+	Line, Column int
+
+	// Snippet is the text of the line where the error occurred.
+	Snippet string
+
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	pos := Pos{File: e.File, Line: e.Line}.String()
+	if e.Column > 0 {
+		if e.File == "" {
+			pos = fmt.Sprintf("%s, column %d", pos, e.Column)
+		} else {
+			pos = fmt.Sprintf("%s:%d", pos, e.Column)
+		}
+	}
+	return fmt.Sprintf("%s: %s", pos, e.Err)
+}
+
+// indexUnquoted returns the index of the first instance of c in s that is
+// not inside a variable reference, or -1 if there is none.
+func indexUnquoted(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == c:
+			return i
+		case s[i] == '$' && i+1 < len(s):
+			if s[i+1] == '(' || s[i+1] == '{' {
+				if end := closingParen(s, i+1); end != -1 {
+					i = end
+					continue
+				}
+			}
+			i++
+		}
+	}
+	return -1
 }
 
 func uniqAndSort(strs []string) []string {
@@ -1,9 +1,13 @@
 package makex
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
 )
 
 func TestParse(t *testing.T) {
@@ -18,8 +22,225 @@ func TestParse(t *testing.T) {
 			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{"y"}, nil}}},
 		},
 		"rule with multiple targets": {
-			data:    `x0 x1:y`,
-			wantErr: errMultipleTargetsUnsupported(0),
+			data: `x0 x1:y`,
+			wantMakefile: &Makefile{Rules: []Rule{
+				&BasicRule{"x0", []string{"y"}, nil},
+				&BasicRule{"x1", []string{"y"}, nil},
+			}},
+		},
+		"rule with multiple targets and recipes": {
+			data: `
+x0 x1: y
+	echo $@`,
+			wantMakefile: &Makefile{Rules: []Rule{
+				&BasicRule{"x0", []string{"y"}, []string{"echo $@"}},
+				&BasicRule{"x1", []string{"y"}, []string{"echo $@"}},
+			}},
+		},
+		"rule with grouped targets": {
+			data: `
+x0 x1 &: y
+	echo $@`,
+			wantMakefile: &Makefile{Rules: []Rule{
+				&GroupedRule{[]string{"x0", "x1"}, []string{"y"}, []string{"echo $@"}},
+			}},
+		},
+		"multiple rules for one target": {
+			data: `
+x: y1
+x: y0 y2
+	c0
+x: y3`,
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{"y0", "y1", "y2", "y3"}, []string{"c0"}}}},
+		},
+		"multiple rules with recipes for one target": {
+			data: `
+x: y0
+	c0
+x: y1
+	c1`,
+			wantErr: errors.New(`line 5: target "x" has recipes in more than one rule`),
+		},
+		"double-colon rules": {
+			data: `
+x:: y0
+	c0 $^
+x:: y1
+	c1 $^`,
+			wantMakefile: &Makefile{Rules: []Rule{
+				&DoubleColonRule{"x", []string{"y0"}, []string{"c0 $^"}},
+				&DoubleColonRule{"x", []string{"y1"}, []string{"c1 $^"}},
+			}},
+		},
+		"single- and double-colon rules for one target": {
+			data: `
+x: y0
+x:: y1`,
+			wantErr: errors.New(`line 3: target "x" has both : and :: rules`),
+		},
+		"ifeq": {
+			data: `
+a = 1
+ifeq ($(a),1)
+b = yes
+else
+b = no
+endif
+ifeq "$(a)" '2'
+c = yes
+else
+c = no
+endif`,
+			wantMakefile: &Makefile{Vars: Vars{"a": {Value: "1"}, "b": {Value: "yes"}, "c": {Value: "no"}}},
+		},
+		"ifneq": {
+			data: `
+ifneq (a, b)
+a = yes
+endif`,
+			wantMakefile: &Makefile{Vars: Vars{"a": {Value: "yes"}}},
+		},
+		"ifdef and ifndef": {
+			data: `
+a = 1
+empty =
+ifdef a
+b = yes
+endif
+ifdef empty
+c = yes
+endif
+ifndef undefined
+d = yes
+endif`,
+			wantMakefile: &Makefile{Vars: Vars{"a": {Value: "1"}, "empty": {Value: ""}, "b": {Value: "yes"}, "d": {Value: "yes"}}},
+		},
+		"else if": {
+			data: `
+a = 2
+ifeq ($(a),1)
+b = 1
+else ifeq ($(a),2)
+b = 2
+else ifeq ($(a),2)
+b = 2 again
+else
+b = other
+endif`,
+			wantMakefile: &Makefile{Vars: Vars{"a": {Value: "2"}, "b": {Value: "2"}}},
+		},
+		"nested conditionals": {
+			data: `
+ifdef undefined
+	ifeq (a,a)
+a = 1
+	else
+a = 2
+	endif
+else
+	ifeq (a,a)
+a = 3
+	else
+a = 4
+	endif
+endif`,
+			wantMakefile: &Makefile{Vars: Vars{"a": {Value: "3"}}},
+		},
+		"conditional recipes": {
+			data: `
+x:
+ifeq (a,b)
+	c0
+else
+	c1
+endif
+	c2`,
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{}, []string{"c1", "c2"}}}},
+		},
+		"missing endif": {
+			data: `
+ifeq (a,b)
+ifdef x
+endif`,
+			wantErr: errors.New("line 2: missing 'endif'"),
+		},
+		"extraneous endif": {
+			data: `
+x: y
+endif`,
+			wantErr: errors.New("line 3: extraneous 'endif'"),
+		},
+		"else without if": {
+			data:    `else`,
+			wantErr: errors.New("line 1: else without if"),
+		},
+		"multiple elses": {
+			data: `
+ifeq (a,b)
+else
+else
+endif`,
+			wantErr: errors.New("line 4: only one 'else' per conditional"),
+		},
+		"invalid conditional": {
+			data:    `ifeq (a)`,
+			wantErr: errors.New("line 1, column 6: invalid syntax in conditional"),
+		},
+		"pattern rule with multiple targets": {
+			data:    `%.x %.y: %.z`,
+			wantErr: errors.New("line 1: pattern rule with multiple targets is not yet implemented"),
+		},
+		"comments": {
+			data: `
+# a comment: not a rule
+x: y # comment
+	echo a # passed to the shell
+# a comment among recipes
+
+	echo b
+a = 1 # comment`,
+			wantMakefile: &Makefile{
+				Rules: []Rule{&BasicRule{"x", []string{"y"}, []string{"echo a # passed to the shell", "echo b"}}},
+				Vars:  Vars{"a": {Value: "1 "}},
+			},
+		},
+		"escaped comment characters": {
+			data: `
+a = x\#y
+b = x\\#comment
+x: $(a)`,
+			wantMakefile: &Makefile{
+				Rules: []Rule{&BasicRule{"x", []string{"x#y"}, nil}},
+				Vars:  Vars{"a": {Value: "x#y"}, "b": {Value: `x\`}},
+			},
+		},
+		"line continuations": {
+			data: `
+a = x \
+    y\
+z
+# a comment \
+x: a
+x: a \
+	b
+	echo 1 \
+	  2
+	echo 3`,
+			wantMakefile: &Makefile{
+				Rules: []Rule{&BasicRule{"x", []string{"a", "b"}, []string{"echo 1 \\\n  2", "echo 3"}}},
+				Vars:  Vars{"a": {Value: "x y z"}},
+			},
+		},
+		"literal dollar signs": {
+			data: `
+a := $$y
+b = $$y
+x: $$y
+	echo "$$HOME"`,
+			wantMakefile: &Makefile{
+				Rules: []Rule{&BasicRule{"x", []string{"$y"}, []string{`echo "$$HOME"`}}},
+				Vars:  Vars{"a": {Value: "$y", Simple: true}, "b": {Value: "$$y"}},
+			},
 		},
 		"rule with multiple prereqs": {
 			data:         `x : y0 y1`,
@@ -49,27 +270,142 @@ x0:y0
 a = 3
 x1:y1
 	c1`,
-			wantMakefile: &Makefile{Rules: []Rule{
-				&BasicRule{"x0", []string{"y0"}, []string{"c0"}},
-				&BasicRule{"x1", []string{"y1"}, []string{"c1"}},
-			}},
+			wantMakefile: &Makefile{
+				Rules: []Rule{
+					&BasicRule{"x0", []string{"y0"}, []string{"c0"}},
+					&BasicRule{"x1", []string{"y1"}, []string{"c1"}},
+				},
+				Vars: Vars{"a": {Value: "3"}},
+			},
 		},
 		"recipe with $@ (target) var": {
 			data: `
 x:
 	echo $@`,
-			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{}, []string{"echo x"}}}},
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{}, []string{"echo $@"}}}},
 		},
 		"recipe with $^ (prereqs) var": {
 			data: `
 x: a b
 	echo $^`,
-			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{"a", "b"}, []string{"echo a b"}}}},
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{"a", "b"}, []string{"echo $^"}}}},
+		},
+		"recursive variable": {
+			data: `
+a = $(b)
+b = y
+x: $(a)`,
+			wantMakefile: &Makefile{
+				Rules: []Rule{&BasicRule{"x", []string{"y"}, nil}},
+				Vars:  Vars{"a": {Value: "$(b)"}, "b": {Value: "y"}},
+			},
+		},
+		"simple variable": {
+			data: `
+b = y0
+a := $(b)
+b = y1
+x: ${a} $b`,
+			wantMakefile: &Makefile{
+				Rules: []Rule{&BasicRule{"x", []string{"y0", "y1"}, nil}},
+				Vars:  Vars{"a": {Value: "y0", Simple: true}, "b": {Value: "y1"}},
+			},
+		},
+		"conditional variable": {
+			data: `
+a = 1
+a ?= 2
+b ?= 3`,
+			wantMakefile: &Makefile{Vars: Vars{"a": {Value: "1"}, "b": {Value: "3"}}},
+		},
+		"append to variable": {
+			data: `
+a = 1
+a += $(c)
+b := 2
+b += $(c)
+c = 3
+d += 4`,
+			wantMakefile: &Makefile{Vars: Vars{
+				"a": {Value: "1 $(c)"},
+				"b": {Value: "2 ", Simple: true},
+				"c": {Value: "3"},
+				"d": {Value: "4"},
+			}},
+		},
+		"shell variable": {
+			data:         `a != echo 1; echo 2`,
+			wantMakefile: &Makefile{Vars: Vars{"a": {Value: "1 2"}}},
+		},
+		"computed variable name": {
+			data: `
+a = b
+$(a)_dir := c`,
+			wantMakefile: &Makefile{Vars: Vars{"a": {Value: "b"}, "b_dir": {Value: "c", Simple: true}}},
+		},
+		"recipe variables are not expanded by Parse": {
+			data: `
+a = 1
+x: y
+	echo $(a) $@ $$HOME
+a = 2`,
+			wantMakefile: &Makefile{
+				Rules: []Rule{&BasicRule{"x", []string{"y"}, []string{"echo $(a) $@ $$HOME"}}},
+				Vars:  Vars{"a": {Value: "2"}},
+			},
+		},
+		"pattern rule": {
+			data: `
+%.o: %.c b a
+	cc -o $@ $< $(flags)
+flags = -O2`,
+			wantMakefile: &Makefile{
+				Rules: []Rule{&PatternRule{"%.o", []string{"%.c", "b", "a"}, []string{"cc -o $@ $< $(flags)"}}},
+				Vars:  Vars{"flags": {Value: "-O2"}},
+			},
+		},
+		"target-specific variables": {
+			data: `
+flags = -O2
+cc := gcc
+x y: flags += -g
+x: cc := clang
+x:
+	$(cc) $(flags)
+y:
+	$(cc) $(flags)`,
+			wantMakefile: &Makefile{
+				Rules: []Rule{
+					&BasicRule{"x", []string{}, []string{"$(cc) $(flags)"}},
+					&BasicRule{"y", []string{}, []string{"$(cc) $(flags)"}},
+				},
+				Vars: Vars{"flags": {Value: "-O2"}, "cc": {Value: "gcc", Simple: true}},
+				TargetVars: map[string]Vars{
+					"x": {"flags": {Value: "-O2 -g"}, "cc": {Value: "clang", Simple: true}},
+					"y": {"flags": {Value: "-O2 -g"}},
+				},
+			},
+		},
+		"pattern-specific variable": {
+			data:    `%.o: flags = -g`,
+			wantErr: errors.New(`line 1: pattern-specific variables are not yet implemented`),
+		},
+		"self-referential variable": {
+			data: `
+a = $(a)
+x: $(a)`,
+			wantErr: errors.New(`line 3: recursive variable "a" references itself (eventually)`),
+		},
+		"recipe with an error is not expanded by Parse": {
+			data: `
+x:
+	echo $(error boom)`,
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{}, []string{"echo $(error boom)"}}}},
 		},
 	}
 	for label, test := range tests {
 		mf, err := Parse([]byte(test.data))
-		if !reflect.DeepEqual(err, test.wantErr) {
+		if fmt.Sprint(err) != fmt.Sprint(test.wantErr) {
 			if test.wantErr == nil {
 				t.Errorf("%s: Parse: error: %s", label, err)
 				continue
@@ -78,6 +414,9 @@ x: a b
 				continue
 			}
 		}
+		if mf != nil {
+			mf.pos = nil
+		}
 		if !reflect.DeepEqual(mf, test.wantMakefile) {
 			t.Errorf("%s: bad parsed Makefile\n=========== got Makefile\n%s\n\n=========== want Makefile\n%s", label, marshalStr(t, mf), marshalStr(t, test.wantMakefile))
 		}
@@ -91,3 +430,60 @@ func marshalStr(t *testing.T, mf *Makefile) string {
 	}
 	return strings.TrimSpace(string(data))
 }
+
+func TestConfig_ParseFile_errors(t *testing.T) {
+	conf := &Config{FS: NewFileSystem(rwvfs.Map(map[string]string{"a.mk": "x: y\n\tc\nifdef x\nendif foo\n"}))}
+	_, err := conf.ParseFile("Makefile", []byte("# comment\ninclude a.mk\n"))
+	want := &ParseError{
+		File:    "a.mk",
+		Line:    4,
+		Column:  7,
+		Snippet: "endif foo",
+		Err:     errors.New("extraneous text after 'endif' directive"),
+	}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("got error %#v, want %#v", err, want)
+	}
+	if got, want := fmt.Sprint(err), "a.mk:4:7: extraneous text after 'endif' directive"; got != want {
+		t.Errorf("got error message %q, want %q", got, want)
+	}
+}
+
+func TestMakefile_Pos(t *testing.T) {
+	conf := &Config{FS: NewFileSystem(rwvfs.Map(map[string]string{"a.mk": "\n%.o: %.c\n\tcc $<\n"}))}
+	mf, err := conf.ParseFile("Makefile", []byte(`
+x: y0
+
+# comment
+x: y1
+	c0
+z:
+include a.mk`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rule Rule
+		want Pos
+	}{
+		{mf.Rule("x"), Pos{"Makefile", 5}},
+		{mf.Rule("z"), Pos{"Makefile", 7}},
+		{mf.PatternRules()[0], Pos{"a.mk", 2}},
+		{mf.PatternRules()[0].Instantiate("b.o", "b"), Pos{"a.mk", 2}},
+		{&BasicRule{TargetFile: "x"}, Pos{}},
+	}
+	for _, test := range tests {
+		if got := mf.Pos(test.rule); got != test.want {
+			t.Errorf("%s: got pos %v, want %v", test.rule.Target(), got, test.want)
+		}
+	}
+
+	expanded, err := conf.Expand(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := expanded.Pos(expanded.Rule("x")), (Pos{"Makefile", 5}); got != want {
+		t.Errorf("after Expand: got pos %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,201 @@
+package makex
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Special targets (other than .PHONY) that change how targets are made:
+//
+//   - .PRECIOUS: its prereqs are not removed when their recipes fail or are
+//     interrupted. Its prereqs may be patterns (such as "%.o").
+//   - .DELETE_ON_ERROR: accepted for compatibility with GNU make, but it has
+//     no effect, because a target whose recipe fails (or is interrupted) is
+//     always removed unless it is precious.
+//   - .INTERMEDIATE: its prereqs are intermediate files. An intermediate file
+//     that doesn't exist is only made if a target that depends on it needs
+//     to be built, and it is removed after the build.
+//   - .SECONDARY: its prereqs are intermediate files that are not removed
+//     after the build. If it has no prereqs, no intermediate files are
+//     removed.
+//   - .ONESHELL: all of the lines of a recipe are run in a single shell, so
+//     that "cd" and shell variables persist from one line to the next.
+//   - .SILENT: the recipes of its prereqs (or, if it has no prereqs, of all
+//     targets) are not logged (as though they began with "@").
+//   - .IGNORE: errors in the recipes of its prereqs (or, if it has no
+//     prereqs, of all targets) are ignored (as though they began with "-").
+//   - .NOTPARALLEL: if it is defined, only one recipe is run at a time,
+//     regardless of ParallelJobs. Its prereqs are ignored.
+
+// specialPrereqs returns the prereqs of the special target name (such as
+// ".PRECIOUS"), and whether it is defined.
+func specialPrereqs(m *Maker, name string) (prereqs []string, defined bool) {
+	rule := m.mf.Rule(name)
+	if rule == nil {
+		return nil, false
+	}
+	return rule.Prereqs(), true
+}
+
+// appliesTo returns whether the special target name (such as ".SILENT")
+// applies to rule, which is when it has no prereqs (so it applies to all
+// rules) or one of rule's targets is a prereq.
+func appliesTo(m *Maker, name string, rule Rule) bool {
+	prereqs, defined := specialPrereqs(m, name)
+	if !defined {
+		return false
+	}
+	if len(prereqs) == 0 {
+		return true
+	}
+	for _, target := range ruleTargets(rule) {
+		if contains(prereqs, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrecious returns whether target is a prereq of .PRECIOUS (or matches one
+// of its pattern prereqs).
+func isPrecious(m *Maker, target string) bool {
+	prereqs, _ := specialPrereqs(m, ".PRECIOUS")
+	for _, p := range prereqs {
+		if p == target {
+			return true
+		}
+		if _, ok := (&PatternRule{TargetPattern: p}).Match(target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isIntermediate returns whether target is an intermediate file. The goals are
+// never treated as intermediate files.
+func isIntermediate(m *Maker, target string) bool {
+	if contains(m.goals, target) {
+		return false
+	}
+	intermediate, _ := specialPrereqs(m, ".INTERMEDIATE")
+	secondary, _ := specialPrereqs(m, ".SECONDARY")
+	return contains(intermediate, target) || contains(secondary, target)
+}
+
+// isSecondary returns whether target is an intermediate file that should not
+// be removed after the build.
+func isSecondary(m *Maker, target string) bool {
+	secondary, defined := specialPrereqs(m, ".SECONDARY")
+	return defined && (len(secondary) == 0 || contains(secondary, target))
+}
+
+// missingIntermediate returns whether target is an intermediate file that
+// doesn't exist.
+func (m *Maker) missingIntermediate(target string) (bool, error) {
+	if !isIntermediate(m, target) {
+		return false, nil
+	}
+	exists, err := m.pathExists(target)
+	return !exists, err
+}
+
+// intermediateNeeded returns whether the missing intermediate file target
+// needs to be made, because a target that depends on it needs to be built,
+// and if so, the reason why.
+func (m *Maker) intermediateNeeded(target string) (bool, string, error) {
+	for _, t := range m.dependents(target) {
+		stale, _, err := m.needsBuild(t)
+		if err != nil {
+			return false, "", err
+		}
+		if stale {
+			return true, fmt.Sprintf("intermediate target %q does not exist and is needed by %q", target, t), nil
+		}
+	}
+	return false, "", nil
+}
+
+// dependents returns the targets that have target as a prereq, in sorted
+// order.
+func (m *Maker) dependents(target string) []string {
+	var dependents []string
+	for t, deps := range m.deps {
+		if contains(deps, target) {
+			dependents = append(dependents, t)
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// bypassIntermediates returns prereqs with each intermediate file (or, if
+// missingOnly is true, each intermediate file that doesn't exist) replaced by
+// its own prereqs, recursively. This lets a target's staleness be determined
+// without making the intermediate files it depends on. bypassed is whether any
+// prereqs were replaced.
+func (m *Maker) bypassIntermediates(prereqs []string, missingOnly bool) (result []string, bypassed bool, err error) {
+	seen := make(map[string]bool)
+	var add func(prereqs []string) error
+	add = func(prereqs []string) error {
+		for _, p := range prereqs {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			bypass := isIntermediate(m, p)
+			if bypass && missingOnly {
+				var err error
+				if bypass, err = m.missingIntermediate(p); err != nil {
+					return err
+				}
+			}
+			if rule := m.rule(p); bypass && rule != nil {
+				bypassed = true
+				if err := add(rule.Prereqs()); err != nil {
+					return err
+				}
+				continue
+			}
+			result = append(result, p)
+		}
+		return nil
+	}
+	if err := add(prereqs); err != nil {
+		return nil, false, err
+	}
+	return result, bypassed, nil
+}
+
+// A bypassedRule is a rule whose missing intermediate prereqs have been
+// replaced by their own prereqs (by bypassIntermediates).
+type bypassedRule struct {
+	Rule
+	prereqs []string
+}
+
+// Prereqs implements Rule.
+func (r bypassedRule) Prereqs() []string { return r.prereqs }
+
+// removeIntermediates removes the intermediate files in targets (which were
+// made during the build) that exist and are not secondary or precious.
+func (m *Maker) removeIntermediates(targets []string) error {
+	var errs Errors
+	for _, target := range targets {
+		if !isIntermediate(m, target) || isSecondary(m, target) || isPrecious(m, target) {
+			continue
+		}
+		if exists, err := m.pathExists(target); err != nil {
+			errs = append(errs, err)
+			continue
+		} else if !exists {
+			continue
+		}
+		if err := m.fs().Remove(target); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package makex
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// runMakefile parses makefile (in which "$(DIR)" refers to a new temporary
+// directory), and runs a Maker (with the options in conf) for goal in that
+// directory. It returns the Config used and the rules' log output.
+func runMakefile(t *testing.T, conf Config, makefile, goal string) (*Config, *Makefile, string, error) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	conf.FS = NewFileSystem(rwvfs.OS(tmpDir))
+	if conf.ParallelJobs == 0 {
+		conf.ParallelJobs = 1
+	}
+	mf, err := conf.Parse([]byte("DIR = " + filepath.ToSlash(tmpDir) + "\n" + makefile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := conf.NewMaker(mf, goal)
+	var logBuf bytes.Buffer
+	var mu sync.Mutex
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(lockedWriter{&logBuf, &mu}, "", 0)
+	}
+	err = mk.Run()
+	return &conf, mf, logBuf.String(), err
+}
+
+// lockedWriter is an io.Writer that can be written to concurrently.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+func TestMaker_Run_failedRecipeTargetRemoval(t *testing.T) {
+	tests := []struct {
+		specialTargets string
+		wantExists     bool
+	}{
+		{specialTargets: "", wantExists: false},
+		{specialTargets: ".DELETE_ON_ERROR:\n", wantExists: false},
+		{specialTargets: ".PRECIOUS: x\n", wantExists: true},
+		{specialTargets: ".PRECIOUS: %\n", wantExists: true},
+		{specialTargets: ".DELETE_ON_ERROR:\n.PRECIOUS: x\n", wantExists: true},
+	}
+	for _, test := range tests {
+		conf, _, _, err := runMakefile(t, Config{}, test.specialTargets+`
+x:
+	echo partial > $(DIR)/x && false
+`, "x")
+		if err == nil {
+			t.Errorf("%q: Run succeeded, want error", test.specialTargets)
+			continue
+		}
+		if exists := isFile(conf.fs(), "x"); exists != test.wantExists {
+			t.Errorf("%q: got x exists %v after failure, want %v", test.specialTargets, exists, test.wantExists)
+		}
+	}
+}
+
+func TestMaker_Run_intermediate(t *testing.T) {
+	const makefile = `
+out: mid
+	cat $(DIR)/mid > $(DIR)/out
+mid: in
+	cat $(DIR)/in > $(DIR)/mid
+in:
+	echo in > $(DIR)/in
+`
+	tests := []struct {
+		specialTargets string
+		wantMidExists  bool
+	}{
+		{specialTargets: "", wantMidExists: true},
+		{specialTargets: ".INTERMEDIATE: mid\n", wantMidExists: false},
+		{specialTargets: ".SECONDARY: mid\n", wantMidExists: true},
+		{specialTargets: ".INTERMEDIATE: mid\n.SECONDARY:\n", wantMidExists: true},
+		{specialTargets: ".INTERMEDIATE: mid\n.PRECIOUS: mid\n", wantMidExists: true},
+	}
+	for _, test := range tests {
+		conf, mf, _, err := runMakefile(t, Config{}, test.specialTargets+makefile, "out")
+		if err != nil {
+			t.Errorf("%q: %s", test.specialTargets, err)
+			continue
+		}
+		if !isFile(conf.fs(), "out") {
+			t.Errorf("%q: out does not exist after Run", test.specialTargets)
+		}
+		if exists := isFile(conf.fs(), "mid"); exists != test.wantMidExists {
+			t.Errorf("%q: got mid exists %v after Run, want %v", test.specialTargets, exists, test.wantMidExists)
+		}
+
+		// A missing intermediate file doesn't make out stale.
+		if upToDate, err := conf.NewMaker(mf, "out").UpToDate(); err != nil {
+			t.Fatal(err)
+		} else if !upToDate {
+			t.Errorf("%q: got UpToDate false after Run, want true", test.specialTargets)
+		}
+	}
+}
+
+func TestMaker_StaleTargetSets_intermediate(t *testing.T) {
+	fs := newModTimeFileSystem(rwvfs.Map(map[string]string{"in": "", "out": ""}))
+	conf := &Config{FS: fs}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "out", PrereqFiles: []string{"mid"}},
+		&BasicRule{TargetFile: "mid", PrereqFiles: []string{"in"}},
+		&BasicRule{TargetFile: ".INTERMEDIATE", PrereqFiles: []string{"mid"}},
+	}}
+
+	staleSets, err := conf.NewMaker(mf, "out").StaleTargetSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]StaleTarget{}; !reflect.DeepEqual(staleSets, want) {
+		t.Errorf("with in older than out: got stale target sets %v, want %v", staleSets, want)
+	}
+
+	fs.(modTimeFileSystem).modTimes["in"] = time.Now()
+	staleSets, err = conf.NewMaker(mf, "out").StaleTargetSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]StaleTarget{
+		{{"mid", `intermediate target "mid" does not exist and is needed by "out"`}},
+		{{"out", `prereq "in" is newer than target "out"`}},
+	}
+	if !reflect.DeepEqual(staleSets, want) {
+		t.Errorf("with in newer than out: got stale target sets %v, want %v", staleSets, want)
+	}
+
+	// An intermediate file that is a goal is made if it doesn't exist.
+	staleSets, err = conf.NewMaker(mf, "mid").StaleTargetSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]StaleTarget{{{"mid", `target "mid" does not exist`}}}; !reflect.DeepEqual(staleSets, want) {
+		t.Errorf("with mid as goal: got stale target sets %v, want %v", staleSets, want)
+	}
+}
+
+func TestMaker_Run_oneShell(t *testing.T) {
+	// The second line fails unless the cd in the first line persists.
+	const makefile = `
+x:
+	cd $(DIR)
+	test "$$PWD" = "$$(cd $(DIR) && pwd)" && echo hi > x
+`
+	conf, _, _, err := runMakefile(t, Config{}, ".ONESHELL:\n"+makefile, "x")
+	if err != nil {
+		t.Fatalf(".ONESHELL: %s", err)
+	}
+	if !isFile(conf.fs(), "x") {
+		t.Error(".ONESHELL: x does not exist after Run")
+	}
+
+	if _, _, _, err := runMakefile(t, Config{}, makefile, "x"); err == nil {
+		t.Error("without .ONESHELL: Run succeeded, want each line to run in its own shell")
+	}
+}
+
+func TestMaker_Run_silentAndIgnore(t *testing.T) {
+	const makefile = `
+x:
+	false
+	touch $(DIR)/x
+`
+	tests := []struct {
+		specialTargets string
+		wantErr        bool
+		wantLogged     bool
+	}{
+		{specialTargets: "", wantErr: true, wantLogged: true},
+		{specialTargets: ".IGNORE:\n", wantLogged: true},
+		{specialTargets: ".IGNORE: x\n", wantLogged: true},
+		{specialTargets: ".IGNORE: y\n", wantErr: true, wantLogged: true},
+		{specialTargets: ".IGNORE:\n.SILENT:\n", wantLogged: false},
+		{specialTargets: ".IGNORE:\n.SILENT: x\n", wantLogged: false},
+	}
+	for _, test := range tests {
+		_, _, logOutput, err := runMakefile(t, Config{Verbose: true}, test.specialTargets+makefile, "x")
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("%q: got error %v, want error %v", test.specialTargets, err, test.wantErr)
+		}
+		if logged := strings.Contains(logOutput, "running command: false"); logged != test.wantLogged {
+			t.Errorf("%q: got command logged %v, want %v (log output: %q)", test.specialTargets, logged, test.wantLogged, logOutput)
+		}
+	}
+}
+
+func TestMaker_Run_notParallel(t *testing.T) {
+	// Each recipe fails if another one is running at the same time.
+	const makefile = `
+all: a b c
+a b c:
+	mkdir $(DIR)/lock && sleep 0.1 && rmdir $(DIR)/lock
+`
+	if _, _, _, err := runMakefile(t, Config{ParallelJobs: 3}, ".NOTPARALLEL:\n"+makefile, "all"); err != nil {
+		t.Errorf("with .NOTPARALLEL: %s", err)
+	}
+}
+
+func TestMaker_shell(t *testing.T) {
+	tests := []struct {
+		makefile  string
+		confShell []string
+		target    string
+		want      []string
+	}{
+		{makefile: "x:", want: []string{"sh", "-c"}},
+		{makefile: "x:", confShell: []string{"bash", "-e", "-c"}, want: []string{"bash", "-e", "-c"}},
+		{makefile: "SHELL = bash\nx:", confShell: []string{"zsh", "-e", "-c"}, want: []string{"bash", "-c"}},
+		{makefile: "opts = -euo pipefail\nSHELL = bash\n.SHELLFLAGS = $(opts) -c\nx:", want: []string{"bash", "-euo", "pipefail", "-c"}},
+		{makefile: ".SHELLFLAGS = -ec\nx:", confShell: []string{"bash", "-c"}, want: []string{"bash", "-ec"}},
+		{makefile: "x: SHELL = bash\nx:\ny:", target: "y", want: []string{"sh", "-c"}},
+		{makefile: "x: SHELL = bash\nx:\ny:", target: "x", want: []string{"bash", "-c"}},
+	}
+	for _, test := range tests {
+		mf, err := Parse([]byte(test.makefile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := test.target
+		if target == "" {
+			target = "x"
+		}
+		conf := &Config{Shell: test.confShell}
+		shell, err := conf.NewMaker(mf, target).shell(mf.Rule(target))
+		if err != nil {
+			t.Errorf("%q: %s", test.makefile, err)
+			continue
+		}
+		if !reflect.DeepEqual(shell, test.want) {
+			t.Errorf("%q: got shell %q, want %q", test.makefile, shell, test.want)
+		}
+	}
+}
+
+func TestMaker_Run_shell(t *testing.T) {
+	// With pipefail, the recipe fails even though the last command in the
+	// pipeline succeeds.
+	const makefile = `
+SHELL = bash
+x: .SHELLFLAGS = -o pipefail -c
+x:
+	false | true
+y:
+	false | true
+`
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not found")
+	}
+	if _, _, _, err := runMakefile(t, Config{}, makefile, "x"); err == nil {
+		t.Error("x: Run succeeded, want the recipe to fail with pipefail")
+	}
+	if _, _, _, err := runMakefile(t, Config{}, makefile, "y"); err != nil {
+		t.Errorf("y: %s", err)
+	}
+}
+
+func TestMaker_Run_expansionErrors(t *testing.T) {
+	tests := []struct {
+		makefile string
+		wantErr  string
+	}{
+		{makefile: "x:\n\techo $(error boom)\n", wantErr: "expanding recipe (boom)"},
+		{makefile: "x: SHELL = $(error boom)\nx:\n\ttrue\n", wantErr: "expanding SHELL and .SHELLFLAGS (boom)"},
+	}
+	for _, test := range tests {
+		_, _, _, err := runMakefile(t, Config{}, test.makefile, "x")
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%q: got error %v, want it to contain %q", test.makefile, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package makex
+
+import (
+	"fmt"
+	"os"
+)
+
+// A StalenessChecker decides whether a rule's targets are stale and need to
+// be built. Set Config.Staleness to use a custom StalenessChecker.
+//
+// A StalenessChecker is only consulted for rules that are not already known
+// to be stale: phony targets, targets with phony prereqs, and the AlwaysMake,
+// AssumeOld, and AssumeNew options are handled by the Maker.
+type StalenessChecker interface {
+	// NeedsBuild returns whether rule's targets need to be built, and if
+	// so, a short description of the reason why (such as "target does not
+	// exist").
+	NeedsBuild(rule Rule) (needsBuild bool, reason string, err error)
+}
+
+// A BuildRecorder is a StalenessChecker that records when rules are built.
+// After a rule's recipes run successfully (or its targets are touched), the
+// Maker calls RecordBuild with the rule.
+type BuildRecorder interface {
+	StalenessChecker
+	RecordBuild(rule Rule) error
+}
+
+// ModTimeChecker is the default StalenessChecker. A rule's targets are stale
+// if any of them does not exist or is older than one of the rule's prereqs
+// (other than those in the Config's AssumeOld).
+type ModTimeChecker struct {
+	*Config
+}
+
+// NeedsBuild implements StalenessChecker.
+func (c ModTimeChecker) NeedsBuild(rule Rule) (bool, string, error) {
+	for _, target := range ruleTargets(rule) {
+		exists, err := c.pathExists(target)
+		if err != nil {
+			return false, "", err
+		}
+		// Always build the target if it doesn't
+		// exist.
+		if !exists {
+			return true, fmt.Sprintf("target %q does not exist", target), nil
+		}
+	}
+
+	for _, target := range ruleTargets(rule) {
+		// The target needs to be built if the mtime
+		// of one of the target's files is greater
+		// than the mtime of the target.
+		targetModTime, err := c.modTime(target)
+		if err != nil {
+			return false, "", err
+		}
+		for _, p := range rule.Prereqs() {
+			if contains(c.AssumeOld, p) {
+				continue
+			}
+			m, err := c.modTime(p)
+			if os.IsNotExist(err) {
+				// The prereq will be made, so the target is stale.
+				return true, fmt.Sprintf("prereq %q does not exist", p), nil
+			} else if err != nil {
+				return false, "", err
+			}
+			if m.After(targetModTime) {
+				return true, fmt.Sprintf("prereq %q is newer than target %q", p, target), nil
+			}
+		}
+	}
+	return false, "", nil
+}
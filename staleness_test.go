@@ -0,0 +1,87 @@
+package makex
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// staleSet is a StalenessChecker that treats the targets in it as stale, and
+// records the targets it was asked about.
+type staleSet struct {
+	stale   map[string]bool
+	checked []string
+}
+
+func (s *staleSet) NeedsBuild(rule Rule) (bool, string, error) {
+	s.checked = append(s.checked, rule.Target())
+	if s.stale[rule.Target()] {
+		return true, "in stale set", nil
+	}
+	return false, "", nil
+}
+
+func TestConfig_Staleness(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}},
+		&BasicRule{TargetFile: "y"},
+		&BasicRule{TargetFile: "z", PrereqFiles: []string{"p"}},
+		&BasicRule{TargetFile: "p"},
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"p"}},
+	}}
+
+	// None of the files exist, but the StalenessChecker decides.
+	checker := &staleSet{stale: map[string]bool{"y": true}}
+	conf := &Config{FS: NewFileSystem(rwvfs.Map(map[string]string{})), Staleness: checker}
+	targetSets, err := conf.NewMaker(mf, "x", "z").TargetSetsNeedingBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range targetSets {
+		sort.Strings(ts)
+	}
+	if want := [][]string{{"p", "y"}, {"z"}}; !reflect.DeepEqual(targetSets, want) {
+		t.Errorf("got target sets %v, want %v", targetSets, want)
+	}
+
+	// The checker isn't consulted about phony targets or targets with
+	// phony prereqs.
+	if want := []string{"y", "x"}; !reflect.DeepEqual(checker.checked, want) {
+		t.Errorf("got checked targets %v, want %v", checker.checked, want)
+	}
+}
+
+func TestModTimeChecker(t *testing.T) {
+	fs := newModTimeFileSystem(rwvfs.Map(map[string]string{"x": "", "y": ""}))
+	fs.(modTimeFileSystem).modTimes["y"] = time.Now()
+	conf := &Config{FS: fs}
+	rule := &BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}}
+
+	if _, ok := conf.NewMaker(&Makefile{}).staleness().(ModTimeChecker); !ok {
+		t.Error("got default StalenessChecker that is not a ModTimeChecker")
+	}
+
+	tests := []struct {
+		rule       Rule
+		wantStale  bool
+		wantReason string
+	}{
+		{rule: rule, wantStale: true, wantReason: `prereq "y" is newer than target "x"`},
+		{rule: &BasicRule{TargetFile: "y", PrereqFiles: []string{"x"}}, wantStale: false},
+		{rule: &BasicRule{TargetFile: "w"}, wantStale: true, wantReason: `target "w" does not exist`},
+		{rule: &BasicRule{TargetFile: "y", PrereqFiles: []string{"w"}}, wantStale: true, wantReason: `prereq "w" does not exist`},
+	}
+	for _, test := range tests {
+		stale, reason, err := (ModTimeChecker{conf}).NeedsBuild(test.rule)
+		if err != nil {
+			t.Errorf("%s: %s", test.rule.Target(), err)
+			continue
+		}
+		if stale != test.wantStale || reason != test.wantReason {
+			t.Errorf("%s: got (%v, %q), want (%v, %q)", test.rule.Target(), stale, reason, test.wantStale, test.wantReason)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package makex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A buildState is the state database used to determine staleness by content
+// hashes (when Config.StateFile is set). It records, for each target that was
+// built, hashes of its recipe and of the contents of its prereqs at the time.
+type buildState struct {
+	mu      sync.Mutex
+	Targets map[string]*targetState `json:"targets"`
+}
+
+// A targetState is the recorded state of a target when it was last built.
+type targetState struct {
+	// Recipe is the hash of the target's expanded recipes.
+	Recipe string `json:"recipe"`
+
+	// Prereqs maps each of the target's prereqs to the hash of its
+	// contents.
+	Prereqs map[string]string `json:"prereqs"`
+}
+
+// loadState reads the state database from StateFile, if it hasn't been read
+// already. A state file that can't be parsed (because it was left partially
+// written, for example) is treated as empty, so all targets are rebuilt.
+func (m *Maker) loadState() (*buildState, error) {
+	m.stateOnce.Do(func() {
+		m.state = &buildState{Targets: make(map[string]*targetState)}
+		data, err := m.readFile(m.StateFile)
+		if os.IsNotExist(err) {
+			return
+		} else if err != nil {
+			m.stateErr = err
+			return
+		}
+		if err := json.Unmarshal(data, m.state); err != nil {
+			m.state = &buildState{}
+		}
+		if m.state.Targets == nil {
+			m.state.Targets = make(map[string]*targetState)
+		}
+	})
+	return m.state, m.stateErr
+}
+
+// hashChecker is the StalenessChecker used when Config.StateFile is set. A
+// rule's targets are stale if any of them does not exist, or if the rule's
+// recipes or the contents of its prereqs have changed since they were last
+// built.
+type hashChecker struct {
+	m *Maker
+}
+
+// NeedsBuild implements StalenessChecker.
+func (c hashChecker) NeedsBuild(rule Rule) (bool, string, error) {
+	m := c.m
+	for _, target := range ruleTargets(rule) {
+		exists, err := m.pathExists(target)
+		if err != nil {
+			return false, "", err
+		}
+		if !exists {
+			return true, fmt.Sprintf("target %q does not exist", target), nil
+		}
+	}
+
+	state, err := m.loadState()
+	if err != nil {
+		return false, "", err
+	}
+	cur, err := m.currentState(rule)
+	if err != nil {
+		return false, "", err
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, target := range ruleTargets(rule) {
+		prev := state.Targets[m.stateKey(rule, target)]
+		if prev == nil {
+			return true, fmt.Sprintf("target %q has no recorded build state", target), nil
+		}
+		if prev.Recipe != cur.Recipe {
+			return true, "recipe changed", nil
+		}
+		if len(prev.Prereqs) != len(cur.Prereqs) {
+			return true, "prereqs changed", nil
+		}
+		for p, hash := range cur.Prereqs {
+			if m.assumedOld(p) {
+				continue
+			}
+			if prevHash, ok := prev.Prereqs[p]; !ok {
+				return true, "prereqs changed", nil
+			} else if prevHash != hash {
+				return true, fmt.Sprintf("contents of prereq %q changed", p), nil
+			}
+		}
+	}
+	return false, "", nil
+}
+
+// RecordBuild implements BuildRecorder. It records the current hashes of
+// rule's recipes and prereqs in the state database, and writes the state
+// database to StateFile.
+func (c hashChecker) RecordBuild(rule Rule) error {
+	m := c.m
+	state, err := m.loadState()
+	if err != nil {
+		return err
+	}
+	cur, err := m.currentState(rule)
+	if err != nil {
+		return err
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, target := range ruleTargets(rule) {
+		state.Targets[m.stateKey(rule, target)] = cur
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return m.replaceFile(m.StateFile, data)
+}
+
+// currentState returns the hashes of rule's expanded recipes and of the
+// current contents of its prereqs. Prereqs that don't exist (and phony
+// prereqs) are given an empty hash.
+func (m *Maker) currentState(rule Rule) (*targetState, error) {
+	// The recipes are expanded as they are when they are run, with the
+	// original prereqs (not those of the bypassedRule that is checked when
+	// intermediate files are missing).
+	recipeRule := rule
+	if r, ok := rule.(bypassedRule); ok {
+		recipeRule = r.Rule
+	}
+	recipes := make([]string, len(rule.Recipes()))
+	for i, recipe := range rule.Recipes() {
+		var err error
+		recipes[i], err = m.expandRecipe(recipeRule, recipe)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The contents of an intermediate file are determined by its own
+	// prereqs, which are hashed instead (so that the state is the same
+	// whether or not the intermediate file exists).
+	prereqs, _, err := m.bypassIntermediates(rule.Prereqs(), false)
+	if err != nil {
+		return nil, err
+	}
+	s := &targetState{
+		Recipe:  hashString(strings.Join(recipes, "\n")),
+		Prereqs: make(map[string]string, len(prereqs)),
+	}
+	for _, p := range prereqs {
+		if isPhony(m, p) {
+			s.Prereqs[p] = ""
+			continue
+		}
+		hash, err := m.hashFile(p)
+		if os.IsNotExist(err) {
+			s.Prereqs[p] = ""
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		s.Prereqs[p] = hash
+	}
+	return s, nil
+}
+
+// hashFile returns the hash of the contents of the file at path. All
+// directories have the same hash.
+func (m *Maker) hashFile(path string) (string, error) {
+	fi, err := m.fs().Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return "dir", nil
+	}
+	f, err := m.fs().Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stateKey returns the key in the state database for a target of rule. A
+// target's double-colon rules are recorded separately.
+func (m *Maker) stateKey(rule Rule, target string) string {
+	if r, ok := rule.(bypassedRule); ok {
+		rule = r.Rule
+	}
+	if rule, ok := rule.(*DoubleColonRule); ok {
+		for i, r := range m.mf.DoubleColonRules(target) {
+			if r == rule {
+				return fmt.Sprintf("%s::%d", target, i)
+			}
+		}
+	}
+	return target
+}
+
+func hashString(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
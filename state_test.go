@@ -0,0 +1,180 @@
+package makex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_StateFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+		StateFile:    ".makex-state",
+	}
+	parse := func(recipe string) *Makefile {
+		mf, err := Parse([]byte(`
+out: in
+	cd ` + filepath.ToSlash(tmpDir) + ` && ` + recipe + `
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mf
+	}
+	writeIn := func(data string) {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, "in"), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkUpToDate := func(label string, mf *Makefile, want bool) {
+		upToDate, err := conf.NewMaker(mf, "out").UpToDate()
+		if err != nil {
+			t.Fatalf("%s: %s", label, err)
+		}
+		if upToDate != want {
+			t.Errorf("%s: got UpToDate %v, want %v", label, upToDate, want)
+		}
+	}
+
+	mf := parse("cat in > out")
+	writeIn("a")
+	checkUpToDate("before build", mf, false)
+	if err := conf.NewMaker(mf, "out").Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkUpToDate("after build", mf, true)
+
+	// Changing a prereq's mtime but not its contents doesn't make the
+	// target stale.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(tmpDir, "in"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	checkUpToDate("after prereq mtime change", mf, true)
+
+	writeIn("b")
+	checkUpToDate("after prereq contents change", mf, false)
+	if err := conf.NewMaker(mf, "out").Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkUpToDate("after rebuild", mf, true)
+
+	// Changing the recipe makes the target stale.
+	checkUpToDate("after recipe change", parse("cp in out"), false)
+
+	// The state is read from the state file by each new Maker.
+	conf2 := *conf
+	conf2.StateFile = ".other-state"
+	upToDate, err := conf2.NewMaker(mf, "out").UpToDate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upToDate {
+		t.Error("with a different state file: got UpToDate true, want false")
+	}
+}
+
+func TestMaker_StateFile_corrupt(t *testing.T) {
+	fs := NewFileSystem(rwvfs.Map(map[string]string{"in": "a", "out": "", "state": `{"targets": {"out":`}))
+	conf := &Config{FS: fs, StateFile: "state"}
+	mf := &Makefile{Rules: []Rule{&BasicRule{TargetFile: "out", PrereqFiles: []string{"in"}}}}
+
+	// A partially written state file is treated as empty.
+	if upToDate, err := conf.NewMaker(mf, "out").UpToDate(); err != nil {
+		t.Fatal(err)
+	} else if upToDate {
+		t.Error("with corrupt state file: got UpToDate true, want false")
+	}
+
+	mk := conf.NewMaker(mf, "out")
+	if err := (hashChecker{mk}).RecordBuild(mf.Rule("out")); err != nil {
+		t.Fatal(err)
+	}
+	if upToDate, err := conf.NewMaker(mf, "out").UpToDate(); err != nil {
+		t.Fatal(err)
+	} else if !upToDate {
+		t.Error("after RecordBuild: got UpToDate false, want true")
+	}
+}
+
+func TestMaker_StateFile_rename(t *testing.T) {
+	fs := &renamingFileSystem{FileSystem: NewFileSystem(rwvfs.Map(map[string]string{"in": "a", "out": ""}))}
+	conf := &Config{FS: fs, StateFile: "state"}
+	mf := &Makefile{Rules: []Rule{&BasicRule{TargetFile: "out", PrereqFiles: []string{"in"}}}}
+
+	mk := conf.NewMaker(mf, "out")
+	if err := (hashChecker{mk}).RecordBuild(mf.Rule("out")); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"state.tmp state"}; !reflect.DeepEqual(fs.renamed, want) {
+		t.Errorf("got renames %q, want %q", fs.renamed, want)
+	}
+	if isFile(fs, "state.tmp") {
+		t.Error("temporary state file exists after RecordBuild")
+	}
+	if upToDate, err := conf.NewMaker(mf, "out").UpToDate(); err != nil {
+		t.Fatal(err)
+	} else if !upToDate {
+		t.Error("after RecordBuild: got UpToDate false, want true")
+	}
+}
+
+// renamingFileSystem is a FileSystem that can rename files, and records the
+// renames.
+type renamingFileSystem struct {
+	FileSystem
+	renamed []string
+}
+
+func (fs *renamingFileSystem) Rename(oldpath, newpath string) error {
+	data, err := (&Config{FS: fs.FileSystem}).readFile(oldpath)
+	if err != nil {
+		return err
+	}
+	if err := (&Config{FS: fs.FileSystem}).createFile(newpath, data); err != nil {
+		return err
+	}
+	fs.renamed = append(fs.renamed, oldpath+" "+newpath)
+	return fs.Remove(oldpath)
+}
+
+func TestMaker_StateFile_intermediate(t *testing.T) {
+	const makefile = `
+.INTERMEDIATE: a.mid
+%.out: %.mid
+	cd $(DIR) && cat $< > $@
+%.mid: %.in
+	cd $(DIR) && cat $< > $@
+a.in:
+	echo in > $(DIR)/a.in
+`
+	conf, mf, _, err := runMakefile(t, Config{StateFile: ".makex-state"}, makefile, "a.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isFile(conf.fs(), "a.mid") {
+		t.Error("intermediate file a.mid exists after Run")
+	}
+
+	// The recipes are hashed the same way whether or not the missing
+	// intermediate file is bypassed.
+	staleSets, err := conf.NewMaker(mf, "a.out").StaleTargetSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(staleSets) != 0 {
+		t.Errorf("got stale target sets %v after Run, want none", staleSets)
+	}
+}
@@ -17,3 +17,13 @@ func (e Errors) Error() string {
 	}
 	return fmt.Sprintf("multiple errors (%d):\n%s", len(e), strings.Join(es, "\n"))
 }
+
+// contains returns whether s is in list.
+func contains(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
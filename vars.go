@@ -0,0 +1,229 @@
+package makex
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Vars is a Makefile's variable table, mapping variable names to their
+// definitions.
+type Vars map[string]Var
+
+// A Var is a variable defined in a Makefile.
+type Var struct {
+	// Value is the variable's value. For recursively expanded variables, it
+	// is the unexpanded text, which is expanded each time the variable is
+	// referenced. For simply expanded variables, it is the text after
+	// expansion.
+	Value string
+
+	// Simple is whether the variable is simply expanded (defined with ":="
+	// or "::=") rather than recursively expanded (defined with "=" or "?=").
+	Simple bool
+}
+
+// lookup returns the definition of the named variable. Variables not defined
+// in vars are looked up in the environment, as in GNU make.
+func (vars Vars) lookup(name string) (Var, bool) {
+	if v, ok := vars[name]; ok {
+		return v, true
+	}
+	if val, ok := os.LookupEnv(name); ok {
+		return Var{Value: val, Simple: true}, true
+	}
+	return Var{}, false
+}
+
+// An expander expands variable references and function calls in Makefile
+// text.
+type expander struct {
+	vars Vars
+
+	// conf is the Config used by functions that access the filesystem,
+	// such as $(wildcard).
+	conf *Config
+
+	// locals are variables that are only defined during the expansion of
+	// a function (such as the loop variable in $(foreach)). They take
+	// precedence over vars.
+	locals Vars
+
+	// callDepth is the number of nested $(call) functions being expanded.
+	callDepth int
+
+	// rule, if non-nil, is the rule whose automatic variables ($@, $^, and
+	// $<) are bound during expansion.
+	rule Rule
+
+	// recipe is whether the text being expanded is a recipe. The result of
+	// expanding a recipe is still escaped: "$$" is left in place, any "$" in
+	// the values of referenced variables is escaped as "$$", and automatic
+	// variables are left unexpanded if rule is nil. ExpandAutoVars performs
+	// the final unescaping when the recipe is run.
+	recipe bool
+
+	// active holds the recursively expanded variables currently being
+	// expanded, to detect variables that reference themselves.
+	active map[string]bool
+}
+
+// expand expands all variable references in s.
+func (x *expander) expand(s string) (string, error) {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case '$':
+			if x.recipe {
+				b.WriteString("$$")
+			} else {
+				b.WriteByte('$')
+			}
+		case '(', '{':
+			end := closingParen(s, i)
+			if end == -1 {
+				return "", fmt.Errorf("unterminated variable reference in %q", s)
+			}
+			v, err := x.ref(s[i+1:end], s[i-1:end+1])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			i = end
+		default:
+			v, err := x.ref(string(c), s[i-1:i+1])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+		}
+	}
+	return b.String(), nil
+}
+
+// ref returns the expansion of a single variable reference or function call,
+// where name is the text inside the reference and raw is the whole reference
+// (such as "$(name)").
+func (x *expander) ref(name, raw string) (string, error) {
+	if fname, args, ok := splitFuncCall(name); ok {
+		if fn, ok := x.lookupFunc(fname); ok {
+			val, err := x.plain().callFunc(fname, fn, args)
+			if err != nil {
+				return "", err
+			}
+			return x.escape(val), nil
+		}
+	}
+
+	if strings.Contains(name, "$") {
+		var err error
+		name, err = x.plain().expand(name)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if varName, from, to, ok := splitSubstitutionRef(name); ok {
+		val, err := x.plain().substitutionRef(varName, from, to)
+		if err != nil {
+			return "", err
+		}
+		return x.escape(val), nil
+	}
+
+	if isAutoVar(name) {
+		if x.rule == nil {
+			if x.recipe {
+				return raw, nil
+			}
+			return "", nil
+		}
+		return x.escape(autoVar(x.rule, name[0])), nil
+	}
+
+	v, ok := x.locals[name]
+	if !ok {
+		v, ok = x.vars.lookup(name)
+	}
+	if !ok {
+		return "", nil
+	}
+	if v.Simple {
+		return x.escape(v.Value), nil
+	}
+
+	if x.active[name] {
+		return "", fmt.Errorf("recursive variable %q references itself (eventually)", name)
+	}
+	if x.active == nil {
+		x.active = make(map[string]bool)
+	}
+	x.active[name] = true
+	defer delete(x.active, name)
+	val, err := x.plain().expand(v.Value)
+	if err != nil {
+		return "", err
+	}
+	return x.escape(val), nil
+}
+
+// plain returns an expander for text that is part of a variable's value or
+// name, which is never escaped even if x is expanding a recipe.
+func (x *expander) plain() *expander {
+	if !x.recipe {
+		return x
+	}
+	x2 := *x
+	x2.recipe = false
+	return &x2
+}
+
+// escape escapes "$" in s if x is expanding a recipe.
+func (x *expander) escape(s string) string {
+	if !x.recipe {
+		return s
+	}
+	return strings.Replace(s, "$", "$$", -1)
+}
+
+// closingParen returns the index of the parenthesis or brace that closes the
+// one at s[open], accounting for nesting, or -1 if there is none.
+func closingParen(s string, open int) int {
+	var close byte = ')'
+	if s[open] == '{' {
+		close = '}'
+	}
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case s[open]:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// shellOutput runs cmd in the shell and returns its output with newlines
+// converted to spaces and the trailing newline removed, as the "!=" operator
+// does in GNU make.
+func shellOutput(cmd string) (string, error) {
+	c := exec.Command("sh", "-c", cmd)
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if _, isExit := err.(*exec.ExitError); err != nil && !isExit {
+		return "", fmt.Errorf("shell command failed: %s (%s)", cmd, err)
+	}
+	return strings.Replace(strings.TrimRight(string(out), "\n"), "\n", " ", -1), nil
+}
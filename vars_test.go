@@ -0,0 +1,44 @@
+package makex
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExpander_expand(t *testing.T) {
+	os.Setenv("MAKEX_TEST_ENV", "e")
+	defer os.Unsetenv("MAKEX_TEST_ENV")
+
+	vars := Vars{
+		"a":    {Value: "$(b)"},
+		"b":    {Value: "x"},
+		"c":    {Value: "$$y", Simple: true},
+		"name": {Value: "b"},
+	}
+	rule := &BasicRule{TargetFile: "t", PrereqFiles: []string{"p0", "p1"}}
+
+	tests := []struct {
+		x     expander
+		input string
+		want  string
+	}{
+		{x: expander{vars: vars}, input: "$(a) ${a} $b", want: "x x x"},
+		{x: expander{vars: vars}, input: "$($(name))", want: "x"},
+		{x: expander{vars: vars}, input: "$(undefined)", want: ""},
+		{x: expander{vars: vars}, input: "$(MAKEX_TEST_ENV)", want: "e"},
+		{x: expander{vars: vars}, input: "$$ $(c)", want: "$ $$y"},
+		{x: expander{vars: vars}, input: "$@ $^", want: " "},
+		{x: expander{vars: vars, recipe: true}, input: "$$ $(c) $@", want: "$$ $$$$y $@"},
+		{x: expander{vars: vars, recipe: true, rule: rule}, input: "$@: $^ $(<)", want: "t: p0 p1 p0"},
+	}
+	for _, test := range tests {
+		got, err := test.x.expand(test.input)
+		if err != nil {
+			t.Errorf("%q: %s", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+	}
+}